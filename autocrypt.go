@@ -0,0 +1,88 @@
+package klaes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// autocryptPolicy withholds keys which can't be used to encrypt messages.
+var autocryptPolicy = Policy{WithholdExpired: true, WithholdRevoked: true}
+
+// serializeAutocryptKey writes the minimal key data recommended by Autocrypt:
+// the primary key, the user ID matching addr with its self-signature, and the
+// subkeys.
+func serializeAutocryptKey(w io.Writer, e *openpgp.Entity, addr string) error {
+	if err := e.PrimaryKey.Serialize(w); err != nil {
+		return err
+	}
+	for _, ident := range e.Identities {
+		if !strings.EqualFold(ident.UserId.Email, addr) {
+			continue
+		}
+		if err := ident.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if err := ident.SelfSignature.Serialize(w); err != nil {
+			return err
+		}
+		break
+	}
+	for _, subkey := range e.Subkeys {
+		if err := subkey.PublicKey.Serialize(w); err != nil {
+			return err
+		}
+		if err := subkey.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveAutocrypt returns the value of an Autocrypt header for the address
+// given in the "addr" query parameter.
+func (s *Server) serveAutocrypt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr := strings.ToLower(r.URL.Query().Get("addr"))
+	if addr == "" {
+		http.Error(w, "Missing addr parameter", http.StatusBadRequest)
+		return
+	}
+
+	el, err := s.backend.discover(r.Context(), "Identity.email = $1"+autocryptPolicy.filter(r), addr)
+	if err == errUnavailable || isDBFailure(err) {
+		serveUnavailable(w)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(el) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Pick the most recent key
+	e := el[0]
+	for _, other := range el[1:] {
+		if other.PrimaryKey.CreationTime.After(e.PrimaryKey.CreationTime) {
+			e = other
+		}
+	}
+
+	var b bytes.Buffer
+	if err := serializeAutocryptKey(&b, e, addr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "addr="+addr+"; keydata="+base64.StdEncoding.EncodeToString(b.Bytes())+"\n")
+}
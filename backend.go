@@ -2,9 +2,14 @@ package klaes
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-openpgp-hkp"
@@ -25,20 +30,63 @@ func primarySelfSignature(e *openpgp.Entity) *packet.Signature {
 	return selfSig
 }
 
-func signatureExpirationTime(sig *packet.Signature) time.Time {
-	if sig.KeyLifetimeSecs == nil {
+// keyExpirationTime returns the expiration time set by a self-signature. The
+// key lifetime is relative to the key creation time.
+func keyExpirationTime(pub *packet.PublicKey, sig *packet.Signature) time.Time {
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
 		return time.Time{}
 	}
 	dur := time.Duration(*sig.KeyLifetimeSecs) * time.Second
-	return sig.CreationTime.Add(dur)
+	return pub.CreationTime.Add(dur)
+}
+
+// sigTypeCertificationRevocation is missing from the packet package, see
+// RFC 4880 section 5.2.1.
+const sigTypeCertificationRevocation packet.SignatureType = 0x30
+
+// identityRevoked reports whether the key owner has revoked a user ID after
+// its last self-signature.
+func identityRevoked(e *openpgp.Entity, ident *openpgp.Identity) bool {
+	for _, sig := range ident.Signatures {
+		if sig.SigType != sigTypeCertificationRevocation || sig.IssuerKeyId == nil || *sig.IssuerKeyId != e.PrimaryKey.KeyId {
+			continue
+		}
+		if sig.CreationTime.Before(ident.SelfSignature.CreationTime) {
+			continue
+		}
+		if e.PrimaryKey.VerifyUserIdSignature(ident.Name, e.PrimaryKey, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func indexFlags(expirationTime time.Time, revoked bool) hkp.IndexFlags {
+	var flags hkp.IndexFlags
+	if revoked {
+		flags |= hkp.IndexKeyRevoked
+	}
+	if !expirationTime.IsZero() && expirationTime.Before(time.Now()) {
+		flags |= hkp.IndexKeyExpired
+	}
+	return flags
 }
 
 type backend struct {
 	db *sql.DB
+	// aead encrypts stored packets, if set
+	aead cipher.AEAD
+	// oldAEADs can also decrypt stored packets
+	oldAEADs []cipher.AEAD
+	breaker  breaker
+	cache    *keyCache
+	// queryTimeout bounds operations run through guard, defaultQueryTimeout
+	// is used if zero
+	queryTimeout time.Duration
 }
 
-func (be *backend) lookup(req *hkp.LookupRequest) (where string, v interface{}) {
-	keyIDSearch := hkp.ParseKeyIDSearch(req.Search)
+func lookupKeyID(search string) (where string, v interface{}) {
+	keyIDSearch := hkp.ParseKeyIDSearch(search)
 	if fingerprint := keyIDSearch.Fingerprint(); fingerprint != nil {
 		return "fingerprint = $1", (*fingerprint)[:]
 	} else if id64 := keyIDSearch.KeyId(); id64 != nil {
@@ -46,42 +94,128 @@ func (be *backend) lookup(req *hkp.LookupRequest) (where string, v interface{})
 	} else if id32 := keyIDSearch.KeyIdShort(); id32 != nil {
 		return "keyid32 = $1", int32(*id32)
 	}
+	return "", nil
+}
 
+func (be *backend) lookup(req *hkp.LookupRequest) (where string, v interface{}) {
+	if where, v := lookupKeyID(req.Search); where != "" {
+		return where, v
+	}
 	return "to_tsvector(Identity.name) @@ to_tsquery($1)", req.Search
 }
 
-func (be *backend) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
-	where, v := be.lookup(req)
+// searchLookup is like lookup, but takes free text typed by a user instead of
+// a tsquery expression.
+func (be *backend) searchLookup(search string) (where string, v interface{}) {
+	if where, v := lookupKeyID(search); where != "" {
+		return where, v
+	}
+	return "to_tsvector(Identity.name) @@ plainto_tsquery($1)", search
+}
 
-	var packets []byte
-	err := be.db.QueryRow(
+func (be *backend) get(ctx context.Context, where string, args ...interface{}) (openpgp.EntityList, error) {
+	return be.cached(ctx, cacheQuery("get", where, args), func(ctx context.Context) (openpgp.EntityList, error) {
+		return be.queryKey(ctx, where, args...)
+	})
+}
+
+func (be *backend) discover(ctx context.Context, where string, args ...interface{}) (openpgp.EntityList, error) {
+	return be.cached(ctx, cacheQuery("discover", where, args), func(ctx context.Context) (openpgp.EntityList, error) {
+		return be.queryKeys(ctx, where, args...)
+	})
+}
+
+func (be *backend) index(ctx context.Context, where string, args ...interface{}) ([]hkp.IndexKey, error) {
+	var keys []hkp.IndexKey
+	err := be.guard(ctx, func(ctx context.Context) error {
+		var err error
+		keys, err = be.queryIndex(ctx, where, args...)
+		return err
+	})
+	return keys, err
+}
+
+func (be *backend) queryKey(ctx context.Context, where string, args ...interface{}) (openpgp.EntityList, error) {
+	var fingerprint, packets []byte
+	err := be.db.QueryRowContext(
+		ctx,
 		`SELECT
-			Key.packets
+			Key.fingerprint, Key.packets
 		FROM Key, Identity WHERE
 			`+where+` AND
+			NOT Key.held AND
+			NOT Key.deprovisioned AND
 			Key.id = Identity.key`,
-		v,
-	).Scan(&packets)
+		args...,
+	).Scan(&fingerprint, &packets)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
+	if packets, err = be.openPackets(packets, fingerprint); err != nil {
+		return nil, err
+	}
+
 	return openpgp.ReadKeyRing(bytes.NewReader(packets))
 }
 
-func (be *backend) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
-	where, v := be.lookup(req)
+func (be *backend) queryKeys(ctx context.Context, where string, args ...interface{}) (openpgp.EntityList, error) {
+	rows, err := be.db.QueryContext(
+		ctx,
+		`SELECT DISTINCT
+			Key.id, Key.fingerprint, Key.packets
+		FROM Key, Identity WHERE
+			`+where+` AND
+			NOT Key.held AND
+			NOT Key.deprovisioned AND
+			Key.id = Identity.key`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	rows, err := be.db.Query(
-		`SELECT
+	var el openpgp.EntityList
+	for rows.Next() {
+		var id int
+		var fingerprint, packets []byte
+		if err := rows.Scan(&id, &fingerprint, &packets); err != nil {
+			return nil, err
+		}
+
+		packets, err := be.openPackets(packets, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		l, err := openpgp.ReadKeyRing(bytes.NewReader(packets))
+		if err != nil {
+			return nil, err
+		}
+		el = append(el, l...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return el, nil
+}
+
+func (be *backend) queryIndex(ctx context.Context, where string, args ...interface{}) ([]hkp.IndexKey, error) {
+	rows, err := be.db.QueryContext(
+		ctx,
+		`SELECT DISTINCT
 			Key.id, Key.fingerprint, Key.creation_time, Key.expiration_time,
-			Key.algo, Key.bit_length
+			Key.algo, Key.bit_length, Key.revoked
 		FROM Key, Identity WHERE
 			`+where+` AND
+			NOT Key.held AND
+			NOT Key.deprovisioned AND
 			Key.id = Identity.key`,
-		v,
+		args...,
 	)
 	if err != nil {
 		return nil, err
@@ -93,18 +227,22 @@ func (be *backend) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
 		var id int
 		var key hkp.IndexKey
 		var fingerprint []byte
-		if err := rows.Scan(&id, &fingerprint, &key.CreationTime, &key.ExpirationTime, &key.Algo, &key.BitLength); err != nil {
+		var revoked bool
+		if err := rows.Scan(&id, &fingerprint, &key.CreationTime, &key.ExpirationTime, &key.Algo, &key.BitLength, &revoked); err != nil {
 			return nil, err
 		}
+		key.Flags = indexFlags(key.ExpirationTime, revoked)
 
 		if len(fingerprint) != 20 {
 			return nil, fmt.Errorf("klaes: invalid key fingerprint length in DB")
 		}
 		copy(key.Fingerprint[:], fingerprint)
 
-		identRows, err := be.db.Query(
+		identRows, err := be.db.QueryContext(
+			ctx,
 			`SELECT
-				Identity.name, Identity.creation_time, Identity.expiration_time
+				Identity.name, Identity.creation_time, Identity.expiration_time,
+				Identity.revoked
 			FROM Identity WHERE
 				Identity.key = $1`,
 			id,
@@ -115,9 +253,11 @@ func (be *backend) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
 
 		for identRows.Next() {
 			var ident hkp.IndexIdentity
-			if err := identRows.Scan(&ident.Name, &ident.CreationTime, &ident.ExpirationTime); err != nil {
+			var revoked bool
+			if err := identRows.Scan(&ident.Name, &ident.CreationTime, &ident.ExpirationTime, &revoked); err != nil {
 				return nil, err
 			}
+			ident.Flags = indexFlags(ident.ExpirationTime, revoked)
 
 			key.Identities = append(key.Identities, ident)
 		}
@@ -134,68 +274,293 @@ func (be *backend) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
 	return keys, nil
 }
 
-func (be *backend) importEntity(e *openpgp.Entity) error {
+// serializeEntity is like openpgp.Entity.Serialize, but keeps revocation
+// signatures.
+func serializeEntity(w io.Writer, e *openpgp.Entity) error {
+	if err := e.PrimaryKey.Serialize(w); err != nil {
+		return err
+	}
+	for _, sig := range e.Revocations {
+		if err := sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	for _, ident := range e.Identities {
+		if err := ident.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if err := ident.SelfSignature.Serialize(w); err != nil {
+			return err
+		}
+		for _, sig := range ident.Signatures {
+			if err := sig.Serialize(w); err != nil {
+				return err
+			}
+		}
+	}
+	for _, subkey := range e.Subkeys {
+		if err := subkey.PublicKey.Serialize(w); err != nil {
+			return err
+		}
+		if err := subkey.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readEntity(packets []byte) (*openpgp.Entity, error) {
+	return openpgp.ReadEntity(packet.NewReader(bytes.NewReader(packets)))
+}
+
+// emailClaim is an email address added to a key while another key, whose
+// ownership has been verified, already has an identity with the same
+// address.
+type emailClaim struct {
+	email       string
+	fingerprint []byte
+}
+
+func (be *backend) expiringKeys(ctx context.Context, until time.Time, domain string) ([]hkp.IndexKey, error) {
+	return be.index(
+		ctx,
+		`Key.expiration_time > $1 AND
+		Key.expiration_time <= $2 AND
+		($3 = '' OR split_part(Identity.email, '@', 2) = $3)`,
+		time.Now(), until, strings.ToLower(domain),
+	)
+}
+
+// importOptions control how a submitted key is stored.
+type importOptions struct {
+	holdClaimed bool
+	// Unless trusted is set, updates to a locked key are rejected if token
+	// isn't its management token.
+	trusted bool
+	token   string
+}
+
+func (be *backend) importEntity(ctx context.Context, e *openpgp.Entity, opts importOptions) ([]emailClaim, error) {
+	var b bytes.Buffer
+	if err := serializeEntity(&b, e); err != nil {
+		return nil, fmt.Errorf("failed to serialize public key: %v", err)
+	}
+
+	var claims []emailClaim
+	err := be.guard(ctx, func(ctx context.Context) error {
+		tx, err := be.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		if !opts.trusted {
+			if err := checkLock(ctx, tx, e.PrimaryKey.Fingerprint[:], opts.token); err != nil {
+				return err
+			}
+		}
+
+		id, c, err := be.storeKey(ctx, tx, b.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if opts.holdClaimed && len(c) > 0 {
+			if _, err := tx.ExecContext(ctx, `UPDATE Key SET held = TRUE WHERE id = $1`, id); err != nil {
+				return fmt.Errorf("failed to hold key: %v", err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		claims = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	be.cache.evict(e.PrimaryKey.Fingerprint[:])
+
+	return claims, nil
+}
+
+// storeKey inserts a key, or merges it into the stored key with the same
+// fingerprint. A new version is recorded if the stored packets change. Email
+// addresses added to the key which are already used by other verified keys
+// are returned.
+func (be *backend) storeKey(ctx context.Context, tx *sql.Tx, packets []byte) (int, []emailClaim, error) {
+	e, err := readEntity(packets)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
 	pub := e.PrimaryKey
+
+	var id int
+	var old []byte
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT id, packets FROM Key WHERE fingerprint = $1 FOR UPDATE`,
+		pub.Fingerprint[:],
+	).Scan(&id, &old)
+	if err == sql.ErrNoRows {
+		id = 0
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("failed to fetch key: %v", err)
+	} else {
+		if old, err = be.openPackets(old, pub.Fingerprint[:]); err != nil {
+			return 0, nil, fmt.Errorf("failed to decrypt key: %v", err)
+		}
+
+		packets, err = mergePackets(old, packets)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to merge key: %v", err)
+		} else if packets == nil {
+			return id, nil, nil
+		}
+
+		if e, err = readEntity(packets); err != nil {
+			return 0, nil, fmt.Errorf("failed to parse merged key: %v", err)
+		}
+	}
+
 	sig := primarySelfSignature(e)
 
 	bitLength, err := pub.BitLength()
 	if err != nil {
-		return fmt.Errorf("failed to get key bit length: %v", err)
+		return 0, nil, fmt.Errorf("failed to get key bit length: %v", err)
 	}
 
 	keyid32 := binary.BigEndian.Uint32(pub.Fingerprint[16:20])
 
-	var b bytes.Buffer
-	if err := e.Serialize(&b); err != nil {
-		return fmt.Errorf("failed to serialize public key: %v", err)
-	}
-
-	tx, err := be.db.Begin()
+	sealed, err := be.sealPackets(packets, pub.Fingerprint[:])
 	if err != nil {
-		return fmt.Errorf("failed to create transaction: %v", err)
+		return 0, nil, fmt.Errorf("failed to encrypt key: %v", err)
 	}
+	digest := sha256.Sum256(sealed)
+
+	oldEmails := make(map[string]bool)
+	if id == 0 {
+		err = tx.QueryRowContext(
+			ctx,
+			`INSERT INTO Key(fingerprint, keyid64, keyid32, creation_time,
+				expiration_time, algo, bit_length, packets, packets_digest,
+				revoked)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+			pub.Fingerprint[:], int64(pub.KeyId), int32(keyid32),
+			pub.CreationTime, keyExpirationTime(pub, sig), pub.PubKeyAlgo,
+			bitLength, sealed, digest[:], len(e.Revocations) > 0,
+		).Scan(&id)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to insert key: %v", err)
+		}
+	} else {
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE Key SET
+				expiration_time = $1, packets = $2, packets_digest = $3,
+				revoked = $4
+			WHERE id = $5`,
+			keyExpirationTime(pub, sig), sealed, digest[:],
+			len(e.Revocations) > 0, id,
+		)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to update key: %v", err)
+		}
 
-	var id int
-	err = tx.QueryRow(
-		`INSERT INTO Key(fingerprint, keyid64, keyid32, creation_time,
-			expiration_time, algo, bit_length, packets)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
-		pub.Fingerprint[:], int64(pub.KeyId), int32(keyid32),
-		pub.CreationTime, signatureExpirationTime(sig), pub.PubKeyAlgo,
-		bitLength, b.Bytes(),
-	).Scan(&id)
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to insert key: %v", err)
+		rows, err := tx.QueryContext(ctx, `SELECT email FROM Identity WHERE key = $1`, id)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to fetch identities: %v", err)
+		}
+		for rows.Next() {
+			var email string
+			if err := rows.Scan(&email); err != nil {
+				rows.Close()
+				return 0, nil, fmt.Errorf("failed to fetch identities: %v", err)
+			}
+			oldEmails[email] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, nil, fmt.Errorf("failed to fetch identities: %v", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM Identity WHERE key = $1`, id); err != nil {
+			return 0, nil, fmt.Errorf("failed to delete identities: %v", err)
+		}
 	}
 
+	var claims []emailClaim
 	for _, ident := range e.Identities {
 		sig := ident.SelfSignature
+		email := strings.ToLower(ident.UserId.Email)
 
 		wkdHash, err := wkd.HashAddress(ident.UserId.Email)
 		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to hash email: %v", err)
+			return 0, nil, fmt.Errorf("failed to hash email: %v", err)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO Identity(key, name, email, creation_time,
+				expiration_time, revoked, wkd_hash)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			id, ident.Name, email, sig.CreationTime,
+			keyExpirationTime(pub, sig), identityRevoked(e, ident), wkdHash,
+		)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to insert identity: %v", err)
 		}
 
-		_, err = tx.Exec(
-			`INSERT INTO Identity(key, name, creation_time, expiration_time,
-				wkd_hash)
-			VALUES ($1, $2, $3, $4, $5)`,
-			id, ident.Name, sig.CreationTime,
-			signatureExpirationTime(sig), wkdHash,
+		if oldEmails[email] {
+			continue
+		}
+		oldEmails[email] = true
+
+		rows, err := tx.QueryContext(
+			ctx,
+			`SELECT DISTINCT
+				Key.fingerprint
+			FROM Key, Identity WHERE
+				Identity.email = $1 AND
+				Identity.key != $2 AND
+				Key.signature_verified AND
+				Key.id = Identity.key`,
+			email, id,
 		)
 		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to insert identity: %v", err)
+			return 0, nil, fmt.Errorf("failed to look up email claims: %v", err)
+		}
+		for rows.Next() {
+			claim := emailClaim{email: email}
+			if err := rows.Scan(&claim.fingerprint); err != nil {
+				rows.Close()
+				return 0, nil, fmt.Errorf("failed to look up email claims: %v", err)
+			}
+			claims = append(claims, claim)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, nil, fmt.Errorf("failed to look up email claims: %v", err)
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO KeyVersion(key, creation_time, packets, packets_digest,
+			revoked)
+		VALUES ($1, $2, $3, $4, $5)`,
+		id, time.Now(), sealed, digest[:], len(e.Revocations) > 0,
+	)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to insert key version: %v", err)
 	}
 
-	return nil
+	if err := appendLogEntry(ctx, tx, pub.Fingerprint[:], packets); err != nil {
+		return 0, nil, err
+	}
+
+	return id, claims, nil
 }
 
 func (be *backend) exportEntities(ch chan<- openpgp.EntityList) error {
@@ -203,7 +568,7 @@ func (be *backend) exportEntities(ch chan<- openpgp.EntityList) error {
 
 	rows, err := be.db.Query(
 		`SELECT
-			Key.packets
+			Key.fingerprint, Key.packets
 		FROM Key`,
 	)
 	if err != nil {
@@ -212,8 +577,13 @@ func (be *backend) exportEntities(ch chan<- openpgp.EntityList) error {
 	defer rows.Close()
 
 	for rows.Next() {
-		var packets []byte
-		if err := rows.Scan(&packets); err != nil {
+		var fingerprint, packets []byte
+		if err := rows.Scan(&fingerprint, &packets); err != nil {
+			return err
+		}
+
+		packets, err := be.openPackets(packets, fingerprint)
+		if err != nil {
 			return err
 		}
 
@@ -230,3 +600,414 @@ func (be *backend) exportEntities(ch chan<- openpgp.EntityList) error {
 
 	return nil
 }
+
+func (be *backend) keyVersions(fingerprint []byte) ([]KeyVersion, error) {
+	rows, err := be.db.Query(
+		`SELECT
+			KeyVersion.id, KeyVersion.creation_time
+		FROM Key, KeyVersion WHERE
+			Key.fingerprint = $1 AND
+			Key.id = KeyVersion.key
+		ORDER BY KeyVersion.id`,
+		fingerprint,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []KeyVersion
+	for rows.Next() {
+		var v KeyVersion
+		if err := rows.Scan(&v.ID, &v.CreationTime); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (be *backend) keyVersionCert(id int) (*cert, error) {
+	var fingerprint, packets []byte
+	err := be.db.QueryRow(
+		`SELECT
+			Key.fingerprint, KeyVersion.packets
+		FROM Key, KeyVersion WHERE
+			KeyVersion.id = $1 AND
+			Key.id = KeyVersion.key`,
+		id,
+	).Scan(&fingerprint, &packets)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("klaes: key version %v not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if packets, err = be.openPackets(packets, fingerprint); err != nil {
+		return nil, err
+	}
+
+	return readCert(packets)
+}
+
+func (be *backend) diffKeyVersions(from, to int) ([]certChange, error) {
+	fromCert, err := be.keyVersionCert(from)
+	if err != nil {
+		return nil, err
+	}
+	toCert, err := be.keyVersionCert(to)
+	if err != nil {
+		return nil, err
+	}
+	return diffCerts(fromCert, toCert), nil
+}
+
+func (be *backend) releaseKey(fingerprint []byte) error {
+	res, err := be.db.Exec(
+		`UPDATE Key SET held = FALSE WHERE fingerprint = $1`,
+		fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("klaes: key not found")
+	}
+	be.cache.evict(fingerprint)
+	return nil
+}
+
+func (be *backend) keyEmails(fingerprint []byte) ([]string, error) {
+	rows, err := be.db.Query(
+		`SELECT
+			Identity.email
+		FROM Key, Identity WHERE
+			Key.fingerprint = $1 AND
+			Key.id = Identity.key`,
+		fingerprint,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+func (be *backend) countKeys() (int, error) {
+	var n int
+	err := be.db.QueryRow(`SELECT count(*) FROM Key`).Scan(&n)
+	return n, err
+}
+
+// keyEvent is a key version along with the kind of change it introduced.
+type keyEvent struct {
+	version     int
+	time        time.Time
+	fingerprint []byte
+	identities  string
+	added       bool
+	revoked     bool
+}
+
+func (be *backend) keyEvents(domain string, limit int) ([]keyEvent, error) {
+	rows, err := be.db.Query(
+		`SELECT
+			v.id, v.creation_time, v.fingerprint, v.revoked, prev.revoked,
+			(SELECT string_agg(Identity.name, ', ') FROM Identity WHERE
+				Identity.key = v.key)
+		FROM (
+			SELECT
+				KeyVersion.id, KeyVersion.key, KeyVersion.creation_time,
+				KeyVersion.revoked, Key.fingerprint
+			FROM Key, KeyVersion WHERE
+				NOT Key.held AND
+				NOT Key.deprovisioned AND
+				Key.id = KeyVersion.key AND
+				($1 = '' OR EXISTS (
+					SELECT 1 FROM Identity WHERE
+						Identity.key = Key.id AND
+						split_part(Identity.email, '@', 2) = $1
+				))
+			ORDER BY KeyVersion.id DESC
+			LIMIT $2
+		) AS v
+		LEFT JOIN LATERAL (
+			SELECT KeyVersion.revoked FROM KeyVersion WHERE
+				KeyVersion.key = v.key AND
+				KeyVersion.id < v.id
+			ORDER BY KeyVersion.id DESC
+			LIMIT 1
+		) AS prev ON TRUE
+		ORDER BY v.id DESC`,
+		strings.ToLower(domain), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []keyEvent
+	for rows.Next() {
+		var ev keyEvent
+		var revoked bool
+		var prevRevoked sql.NullBool
+		var identities sql.NullString
+		if err := rows.Scan(&ev.version, &ev.time, &ev.fingerprint, &revoked, &prevRevoked, &identities); err != nil {
+			return nil, err
+		}
+		ev.added = !prevRevoked.Valid
+		ev.revoked = revoked && !prevRevoked.Bool
+		ev.identities = identities.String
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// syncDirectory replaces the directory email addresses, and flags keys with
+// identities outside of the directory as deprovisioned.
+func (be *backend) syncDirectory(emails []string, force bool) ([][]byte, error) {
+	tx, err := be.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if !force {
+		unique := make(map[string]bool, len(emails))
+		for _, email := range emails {
+			unique[email] = true
+		}
+
+		var current int
+		if err := tx.QueryRow(`SELECT count(*) FROM DirectoryEmail`).Scan(&current); err != nil {
+			return nil, fmt.Errorf("failed to count directory emails: %v", err)
+		}
+		if len(unique) == 0 {
+			return nil, fmt.Errorf("klaes: refusing to sync an empty directory")
+		} else if len(unique) < current/2 {
+			return nil, fmt.Errorf("klaes: refusing to shrink the directory from %v to %v email addresses", current, len(unique))
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM DirectoryEmail`); err != nil {
+		return nil, fmt.Errorf("failed to clear directory: %v", err)
+	}
+	for _, email := range emails {
+		_, err := tx.Exec(
+			`INSERT INTO DirectoryEmail(email) VALUES ($1)
+			ON CONFLICT DO NOTHING`,
+			email,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert directory email: %v", err)
+		}
+	}
+
+	rows, err := tx.Query(
+		`UPDATE Key SET deprovisioned = EXISTS (
+			SELECT 1 FROM Identity WHERE
+				Identity.key = Key.id AND
+				Identity.email != '' AND
+				Identity.email NOT IN (SELECT email FROM DirectoryEmail)
+		)
+		RETURNING fingerprint, deprovisioned`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to flag deprovisioned keys: %v", err)
+	}
+	var fingerprints [][]byte
+	for rows.Next() {
+		var fingerprint []byte
+		var deprovisioned bool
+		if err := rows.Scan(&fingerprint, &deprovisioned); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if deprovisioned {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	for _, fingerprint := range fingerprints {
+		be.cache.evict(fingerprint)
+	}
+
+	return fingerprints, nil
+}
+
+// directoryMissing returns the email addresses not in the directory.
+func (be *backend) directoryMissing(emails []string) ([]string, error) {
+	var missing []string
+	for _, email := range emails {
+		var ok bool
+		err := be.db.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM DirectoryEmail WHERE email = $1)`,
+			email,
+		).Scan(&ok)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, email)
+		}
+	}
+	return missing, nil
+}
+
+const revalidateBatchSize = 100
+
+// revalidateKeys re-derives the expiration and revocation status of keys and
+// identities from the stored packets, since they may have been computed by
+// an older version. Keys which can't be read are passed to report and
+// skipped. It returns the number of keys whose status changed.
+func (be *backend) revalidateKeys(report func(msg string)) (int, error) {
+	n := 0
+	var lastID int
+	for {
+		rows, err := be.db.Query(
+			`SELECT id FROM Key WHERE id > $1 ORDER BY id LIMIT $2`,
+			lastID, revalidateBatchSize,
+		)
+		if err != nil {
+			return n, err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return n, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return n, err
+		}
+		if len(ids) == 0 {
+			return n, nil
+		}
+		lastID = ids[len(ids)-1]
+
+		for _, id := range ids {
+			changed, err := be.revalidateKey(id, report)
+			if err != nil {
+				return n, err
+			} else if changed {
+				n++
+			}
+		}
+	}
+}
+
+// revalidateKey updates the status of a single key. The key is locked so
+// that a concurrent update isn't overwritten with a status derived from
+// older packets.
+func (be *backend) revalidateKey(id int, report func(msg string)) (bool, error) {
+	tx, err := be.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to create transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var fingerprint, packets []byte
+	err = tx.QueryRow(
+		`SELECT fingerprint, packets FROM Key WHERE id = $1 FOR UPDATE`,
+		id,
+	).Scan(&fingerprint, &packets)
+	if err == sql.ErrNoRows {
+		// Deleted in the meantime
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to fetch key %v: %v", id, err)
+	}
+
+	packets, err = be.openPackets(packets, fingerprint)
+	if err != nil {
+		report(fmt.Sprintf("key %X: %v", fingerprint, err))
+		return false, nil
+	}
+	e, err := readEntity(packets)
+	if err != nil {
+		report(fmt.Sprintf("key %X: failed to parse packets: %v", fingerprint, err))
+		return false, nil
+	}
+	pub := e.PrimaryKey
+
+	res, err := tx.Exec(
+		`UPDATE Key SET
+			expiration_time = $1, revoked = $2
+		WHERE
+			id = $3 AND
+			(expiration_time, revoked) IS DISTINCT FROM ($1, $2)`,
+		keyExpirationTime(pub, primarySelfSignature(e)),
+		len(e.Revocations) > 0, id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update key %v: %v", id, err)
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	for _, ident := range e.Identities {
+		sig := ident.SelfSignature
+		res, err := tx.Exec(
+			`UPDATE Identity SET
+				creation_time = $1, expiration_time = $2, revoked = $3
+			WHERE
+				key = $4 AND name = $5 AND
+				(creation_time, expiration_time, revoked) IS DISTINCT FROM ($1, $2, $3)`,
+			sig.CreationTime, keyExpirationTime(pub, sig),
+			identityRevoked(e, ident), id, ident.Name,
+		)
+		if err != nil {
+			return false, fmt.Errorf("failed to update identity of key %v: %v", id, err)
+		}
+		identChanged, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		changed += identChanged
+	}
+
+	if changed == 0 {
+		return false, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	be.cache.evict(fingerprint)
+	return true, nil
+}
@@ -0,0 +1,167 @@
+package klaes
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const maxBatchQueries = 1000
+
+// batchLookup groups batch queries by the column they match, so that each
+// group is looked up with a single query.
+type batchLookup struct {
+	fingerprints pq.ByteaArray
+	keyIDs       pq.Int64Array
+	shortKeyIDs  pq.Int64Array
+	emails       pq.StringArray
+}
+
+// add parses a batch query: a fingerprint, a key ID or an email address.
+// Fingerprints and key IDs may omit the "0x" prefix.
+func (bl *batchLookup) add(query string) error {
+	if strings.Contains(query, "@") {
+		bl.emails = append(bl.emails, strings.ToLower(query))
+		return nil
+	}
+
+	switch len(query) {
+	case 8, 16, 40:
+		if _, err := hex.DecodeString(query); err == nil {
+			query = "0x" + query
+		}
+	}
+	keyIDSearch := hkp.ParseKeyIDSearch(query)
+	if fingerprint := keyIDSearch.Fingerprint(); fingerprint != nil {
+		bl.fingerprints = append(bl.fingerprints, (*fingerprint)[:])
+	} else if id64 := keyIDSearch.KeyId(); id64 != nil {
+		bl.keyIDs = append(bl.keyIDs, int64(*id64))
+	} else if id32 := keyIDSearch.KeyIdShort(); id32 != nil {
+		bl.shortKeyIDs = append(bl.shortKeyIDs, int64(int32(*id32)))
+	} else {
+		return fmt.Errorf("invalid query %q: expected a fingerprint, key ID or email address", query)
+	}
+	return nil
+}
+
+// where returns the SQL conditions to look up, one per non-empty group.
+func (bl *batchLookup) where() (conds []string, args []interface{}) {
+	if len(bl.fingerprints) > 0 {
+		conds, args = append(conds, "fingerprint = ANY($1)"), append(args, bl.fingerprints)
+	}
+	if len(bl.keyIDs) > 0 {
+		conds, args = append(conds, "keyid64 = ANY($1)"), append(args, bl.keyIDs)
+	}
+	if len(bl.shortKeyIDs) > 0 {
+		conds, args = append(conds, "keyid32 = ANY($1)"), append(args, bl.shortKeyIDs)
+	}
+	if len(bl.emails) > 0 {
+		conds, args = append(conds, "Identity.email = ANY($1)"), append(args, bl.emails)
+	}
+	return conds, args
+}
+
+// serveBatch looks up several keys at once. The request body contains one
+// fingerprint, key ID or email address per line. All matching keys are
+// returned in a single armored keyring, or as JSON metadata if the "op"
+// query parameter is set to "index".
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var queries []string
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, 1<<20))
+	for scanner.Scan() {
+		if q := strings.TrimSpace(scanner.Text()); q != "" {
+			queries = append(queries, q)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(queries) > maxBatchQueries {
+		http.Error(w, fmt.Sprintf("Too many queries (maximum %v)", maxBatchQueries), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var bl batchLookup
+	for _, q := range queries {
+		if err := bl.add(q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	index := r.URL.Query().Get("op") == "index"
+	filter := s.HKPPolicy.filter(r)
+	seen := make(map[[20]byte]bool)
+	var el openpgp.EntityList
+	keys := []jsonKey{}
+	conds, args := bl.where()
+	for i, where := range conds {
+		v := args[i]
+		if index {
+			l, err := s.backend.index(r.Context(), where+filter, v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for i := range l {
+				if !seen[l[i].Fingerprint] {
+					seen[l[i].Fingerprint] = true
+					keys = append(keys, newJSONKey(&l[i]))
+				}
+			}
+		} else {
+			l, err := s.backend.discover(r.Context(), where+filter, v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, e := range l {
+				if !seen[e.PrimaryKey.Fingerprint] {
+					seen[e.PrimaryKey.Fingerprint] = true
+					el = append(el, e)
+				}
+			}
+		}
+	}
+
+	if index {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(keys); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if len(el) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range el {
+		if err := serializeEntity(aw, e); err != nil {
+			panic(err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,49 @@
+package klaes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestBatchLookup(t *testing.T) {
+	fingerprint := []byte{
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF, 0x01, 0x23,
+		0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF, 0x01, 0x23, 0x45, 0x67,
+	}
+
+	var bl batchLookup
+	for _, q := range []string{
+		"0x0123456789ABCDEF0123456789ABCDEF01234567",
+		"0123456789abcdef0123456789abcdef01234567",
+		"0123456789ABCDEF",
+		"0x89ABCDEF",
+		"Alice@Example.org",
+	} {
+		if err := bl.add(q); err != nil {
+			t.Fatalf("add(%q) = %v", q, err)
+		}
+	}
+
+	want := batchLookup{
+		fingerprints: pq.ByteaArray{fingerprint, fingerprint},
+		keyIDs:       pq.Int64Array{0x0123456789ABCDEF},
+		shortKeyIDs:  pq.Int64Array{int64(int32(-0x76543211))},
+		emails:       pq.StringArray{"alice@example.org"},
+	}
+	if !reflect.DeepEqual(bl, want) {
+		t.Errorf("batchLookup = %+v, want %+v", bl, want)
+	}
+
+	conds, args := bl.where()
+	if len(conds) != 4 || len(args) != 4 {
+		t.Errorf("where() = %v, %v, want 4 conditions", conds, args)
+	}
+
+	for _, q := range []string{"alice", "0123456", "0xZZZZZZZZ", "0123456789ABCDEF0"} {
+		if err := bl.add(q); err == nil {
+			t.Errorf("add(%q) succeeded", q)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package klaes
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"github.com/emersion/go-openpgp-wkd"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// The breaker trips after this many consecutive database failures...
+	breakerThreshold = 5
+	// ...and lets a request through again after this delay.
+	breakerCooldown = 10 * time.Second
+)
+
+const defaultCacheSize = 1000
+
+// defaultQueryTimeout bounds database operations started by requests.
+const defaultQueryTimeout = 10 * time.Second
+
+// errUnavailable is returned instead of querying the database while the
+// circuit breaker is open.
+var errUnavailable = errors.New("klaes: database unavailable")
+
+// isDBFailure checks whether an error means the database can't be reached,
+// as opposed to e.g. an invalid query.
+func isDBFailure(err error) bool {
+	switch err {
+	case nil, sql.ErrNoRows, context.Canceled:
+		return false
+	case driver.ErrBadConn, sql.ErrConnDone, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded:
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// lib/pq reports server shutdowns as fatal errors
+	if fatal, ok := err.(interface{ Fatal() bool }); ok {
+		return fatal.Fatal()
+	}
+	return false
+}
+
+// breaker stops queries from reaching a failing database. Once open, a
+// single query is let through after the cooldown to check whether the
+// database is back.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if now := time.Now(); now.After(b.openUntil) {
+		b.openUntil = now.Add(breakerCooldown)
+		return true
+	}
+	return false
+}
+
+func (b *breaker) record(err error) {
+	if err == context.Canceled {
+		// The client went away, this says nothing about the database
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isDBFailure(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures == breakerThreshold {
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= breakerThreshold
+}
+
+// keyCache keeps the results of the most recent key lookups, to be served
+// while the database is unavailable. Lookups returning a key are evicted
+// when the key is updated, held, released or deleted.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int
+	l       *list.List
+	entries map[string]*list.Element
+}
+
+type keyCacheEntry struct {
+	query string
+	el    openpgp.EntityList
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{
+		size:    size,
+		l:       list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *keyCache) get(query string) (openpgp.EntityList, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[query]
+	if !ok {
+		return nil, false
+	}
+	c.l.MoveToFront(elem)
+	return elem.Value.(*keyCacheEntry).el, true
+}
+
+func (c *keyCache) add(query string, el openpgp.EntityList) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[query]; ok {
+		elem.Value.(*keyCacheEntry).el = el
+		c.l.MoveToFront(elem)
+		return
+	}
+
+	c.entries[query] = c.l.PushFront(&keyCacheEntry{query, el})
+	for c.l.Len() > c.size {
+		elem := c.l.Back()
+		c.l.Remove(elem)
+		delete(c.entries, elem.Value.(*keyCacheEntry).query)
+	}
+}
+
+// evict drops the cached lookups which returned the key with the given
+// fingerprint.
+func (c *keyCache) evict(fingerprint []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for query, elem := range c.entries {
+		for _, e := range elem.Value.(*keyCacheEntry).el {
+			if bytes.Equal(e.PrimaryKey.Fingerprint[:], fingerprint) {
+				c.l.Remove(elem)
+				delete(c.entries, query)
+				break
+			}
+		}
+	}
+}
+
+func (c *keyCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.l.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// guard runs a database operation through the circuit breaker, with a
+// timeout. The caller gets context.DeadlineExceeded once the timeout expires
+// even if the driver is stuck on a hung connection, in which case f keeps
+// running in the background until the connection fails.
+func (be *backend) guard(ctx context.Context, f func(ctx context.Context) error) error {
+	if !be.breaker.allow() {
+		return errUnavailable
+	}
+
+	timeout := be.queryTimeout
+	if timeout == 0 {
+		timeout = defaultQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+		if err != nil && ctx.Err() != nil {
+			// The driver reports cancelled queries with its own errors
+			err = ctx.Err()
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	be.breaker.record(err)
+	return err
+}
+
+// cached runs a key lookup through the circuit breaker. Results are cached
+// and served instead while the database is unavailable.
+func (be *backend) cached(ctx context.Context, query string, fetch func(ctx context.Context) (openpgp.EntityList, error)) (openpgp.EntityList, error) {
+	var el openpgp.EntityList
+	err := be.guard(ctx, func(ctx context.Context) error {
+		var err error
+		el, err = fetch(ctx)
+		return err
+	})
+	if err == errUnavailable || isDBFailure(err) {
+		if el, ok := be.cache.get(query); ok {
+			return el, nil
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(el) > 0 {
+		be.cache.add(query, el)
+	}
+	return el, nil
+}
+
+func cacheQuery(op, where string, args []interface{}) string {
+	return fmt.Sprintf("%v %q %q", op, where, args)
+}
+
+// SetCacheSize sets the number of key lookups kept to be served while the
+// database is unavailable. Zero disables the cache.
+func (s *Server) SetCacheSize(n int) {
+	s.backend.cache = newKeyCache(n)
+}
+
+// SetQueryTimeout sets how long database operations started by requests may
+// take before failing. Timeouts count as database failures for the circuit
+// breaker.
+func (s *Server) SetQueryTimeout(d time.Duration) {
+	s.backend.queryTimeout = d
+}
+
+// FlushCache empties the key lookup cache.
+func (s *Server) FlushCache() {
+	s.backend.cache.flush()
+}
+
+// Degraded checks whether the database is considered unavailable. Only
+// cached key lookups are served meanwhile.
+func (s *Server) Degraded() bool {
+	return s.backend.breaker.open()
+}
+
+func serveUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%v", int(breakerCooldown.Seconds())))
+	http.Error(w, errUnavailable.Error(), http.StatusServiceUnavailable)
+}
+
+// servesDegraded checks whether a request can be answered from the key
+// lookup cache.
+func servesDegraded(r *http.Request) bool {
+	switch {
+	case r.URL.Path == hkp.Base+"/lookup":
+		return r.URL.Query().Get("op") == "get"
+	case strings.HasPrefix(r.URL.Path, wkd.Base+"/"), r.URL.Path == "/autocrypt":
+		return r.Method == http.MethodGet
+	default:
+		return false
+	}
+}
@@ -0,0 +1,54 @@
+package klaes
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGuardTimeout(t *testing.T) {
+	be := backend{queryTimeout: 10 * time.Millisecond}
+
+	// A query stuck on a hung connection ignores its context
+	hung := make(chan struct{})
+	defer close(hung)
+	for i := 0; i < breakerThreshold; i++ {
+		err := be.guard(context.Background(), func(ctx context.Context) error {
+			<-hung
+			return nil
+		})
+		if err != context.DeadlineExceeded {
+			t.Fatalf("guard() = %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+
+	if !be.breaker.open() {
+		t.Fatal("breaker not open after repeated timeouts")
+	}
+	err := be.guard(context.Background(), func(ctx context.Context) error {
+		t.Error("query run while the breaker is open")
+		return nil
+	})
+	if err != errUnavailable {
+		t.Errorf("guard() = %v, want %v", err, errUnavailable)
+	}
+}
+
+func TestGuardCanceled(t *testing.T) {
+	var be backend
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < breakerThreshold; i++ {
+		err := be.guard(ctx, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		if err != context.Canceled {
+			t.Fatalf("guard() = %v, want %v", err, context.Canceled)
+		}
+	}
+	if be.breaker.open() {
+		t.Error("breaker open after requests were canceled by clients")
+	}
+}
@@ -0,0 +1,106 @@
+package klaes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+// CachePolicy controls the Cache-Control and Expires headers of successful
+// responses, e.g. when klaes is behind a CDN. A zero duration omits the
+// headers. Responses of submission and management endpoints are never
+// cached.
+type CachePolicy struct {
+	// KeyMaxAge applies to HKP lookups by fingerprint, which are marked as
+	// immutable.
+	KeyMaxAge time.Duration
+	// LookupMaxAge applies to other lookups and searches.
+	LookupMaxAge time.Duration
+}
+
+type cacheClass int
+
+const (
+	cacheLookup cacheClass = iota
+	cacheKey
+	cacheAdmin
+)
+
+func requestCacheClass(r *http.Request) cacheClass {
+	switch {
+	case r.URL.Path == hkp.Base+"/lookup":
+		q := r.URL.Query()
+		if q.Get("op") == "get" && hkp.ParseKeyIDSearch(q.Get("search")).Fingerprint() != nil {
+			return cacheKey
+		}
+		return cacheLookup
+	case r.URL.Path == hkp.Base+"/add", r.URL.Path == "/manage",
+		r.URL.Path == "/revoke", r.URL.Path == "/batch",
+		strings.HasPrefix(r.URL.Path, "/submission/"):
+		return cacheAdmin
+	default:
+		return cacheLookup
+	}
+}
+
+func (p *CachePolicy) header(class cacheClass) (string, time.Duration) {
+	switch class {
+	case cacheKey:
+		if p.KeyMaxAge > 0 {
+			return fmt.Sprintf("public, max-age=%v, immutable", int(p.KeyMaxAge.Seconds())), p.KeyMaxAge
+		}
+	case cacheLookup:
+		if p.LookupMaxAge > 0 {
+			return fmt.Sprintf("public, max-age=%v", int(p.LookupMaxAge.Seconds())), p.LookupMaxAge
+		}
+	case cacheAdmin:
+		return "no-store", 0
+	}
+	return "", 0
+}
+
+// cacheControlWriter sets the cache headers once the response status is
+// known, so that errors aren't cached.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	maxAge       time.Duration
+	wroteHeader  bool
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		// no-store applies to errors too
+		if code == http.StatusOK || w.maxAge == 0 {
+			h.Set("Cache-Control", w.cacheControl)
+		}
+		if code == http.StatusOK && w.maxAge > 0 {
+			h.Set("Expires", time.Now().Add(w.maxAge).UTC().Format(http.TimeFormat))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (p *CachePolicy) wrap(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	cacheControl, maxAge := p.header(requestCacheClass(r))
+	if cacheControl == "" {
+		return w
+	}
+	return &cacheControlWriter{
+		ResponseWriter: w,
+		cacheControl:   cacheControl,
+		maxAge:         maxAge,
+	}
+}
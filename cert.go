@@ -0,0 +1,300 @@
+package klaes
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// OpenPGP packet tags, see RFC 4880 section 4.3.
+const (
+	tagSignature     = 2
+	tagPublicKey     = 6
+	tagUserID        = 13
+	tagPublicSubkey  = 14
+	tagUserAttribute = 17
+)
+
+// certComponent is a primary key, user ID, user attribute or subkey packet
+// along with the signatures following it.
+type certComponent struct {
+	packet *packet.OpaquePacket
+	sigs   []*packet.OpaquePacket
+}
+
+// cert is a transferable public key, kept as raw packets so that nothing is
+// lost when it's stored and merged.
+type cert struct {
+	primary certComponent
+	uids    []certComponent
+	subkeys []certComponent
+}
+
+func packetKey(p *packet.OpaquePacket) string {
+	return string([]byte{p.Tag}) + string(p.Contents)
+}
+
+func readCert(b []byte) (*cert, error) {
+	var c cert
+	var cur *certComponent
+	or := packet.NewOpaqueReader(bytes.NewReader(b))
+	for {
+		p, err := or.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch p.Tag {
+		case tagPublicKey:
+			if cur != nil {
+				return nil, fmt.Errorf("klaes: multiple primary keys in certificate")
+			}
+			c.primary.packet = p
+			cur = &c.primary
+		case tagUserID, tagUserAttribute:
+			c.uids = append(c.uids, certComponent{packet: p})
+			cur = &c.uids[len(c.uids)-1]
+		case tagPublicSubkey:
+			c.subkeys = append(c.subkeys, certComponent{packet: p})
+			cur = &c.subkeys[len(c.subkeys)-1]
+		case tagSignature:
+			if cur == nil {
+				return nil, fmt.Errorf("klaes: signature before primary key")
+			}
+			cur.sigs = append(cur.sigs, p)
+		default:
+			// Trust packets and unknown packets are dropped
+		}
+
+		if cur == nil {
+			return nil, fmt.Errorf("klaes: certificate doesn't start with a primary key")
+		}
+	}
+
+	if c.primary.packet == nil {
+		return nil, fmt.Errorf("klaes: empty certificate")
+	}
+	return &c, nil
+}
+
+func (comp *certComponent) serialize(w io.Writer) error {
+	if err := comp.packet.Serialize(w); err != nil {
+		return err
+	}
+	for _, sig := range comp.sigs {
+		if err := sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cert) serialize(w io.Writer) error {
+	if err := c.primary.serialize(w); err != nil {
+		return err
+	}
+	for i := range c.uids {
+		if err := c.uids[i].serialize(w); err != nil {
+			return err
+		}
+	}
+	for i := range c.subkeys {
+		if err := c.subkeys[i].serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cert) bytes() ([]byte, error) {
+	var b bytes.Buffer
+	if err := c.serialize(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func findComponent(l []certComponent, p *packet.OpaquePacket) *certComponent {
+	k := packetKey(p)
+	for i := range l {
+		if packetKey(l[i].packet) == k {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+func mergeSigs(dst *certComponent, sigs []*packet.OpaquePacket) bool {
+	changed := false
+	known := make(map[string]bool, len(dst.sigs))
+	for _, sig := range dst.sigs {
+		known[packetKey(sig)] = true
+	}
+	for _, sig := range sigs {
+		if k := packetKey(sig); !known[k] {
+			known[k] = true
+			dst.sigs = append(dst.sigs, sig)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func mergeComponents(dst []certComponent, src []certComponent) ([]certComponent, bool) {
+	changed := false
+	for _, comp := range src {
+		if existing := findComponent(dst, comp.packet); existing != nil {
+			if mergeSigs(existing, comp.sigs) {
+				changed = true
+			}
+		} else {
+			changed = true
+			dst = append(dst, certComponent{
+				packet: comp.packet,
+				sigs:   append([]*packet.OpaquePacket(nil), comp.sigs...),
+			})
+		}
+	}
+	return dst, changed
+}
+
+// merge adds the packets of other which are missing from c. Both
+// certificates must have the same primary key. It reports whether c has
+// changed.
+func (c *cert) merge(other *cert) (bool, error) {
+	if packetKey(c.primary.packet) != packetKey(other.primary.packet) {
+		return false, fmt.Errorf("klaes: cannot merge certificates with different primary keys")
+	}
+	changed := mergeSigs(&c.primary, other.primary.sigs)
+	var uidsChanged, subkeysChanged bool
+	c.uids, uidsChanged = mergeComponents(c.uids, other.uids)
+	c.subkeys, subkeysChanged = mergeComponents(c.subkeys, other.subkeys)
+	return changed || uidsChanged || subkeysChanged, nil
+}
+
+// mergePackets merges two serialized certificates for the same key. If new
+// doesn't bring anything, a nil slice is returned.
+func mergePackets(old, new []byte) ([]byte, error) {
+	c, err := readCert(old)
+	if err != nil {
+		return nil, err
+	}
+	other, err := readCert(new)
+	if err != nil {
+		return nil, err
+	}
+	if changed, err := c.merge(other); err != nil {
+		return nil, err
+	} else if !changed {
+		return nil, nil
+	}
+	return c.bytes()
+}
+
+// certChange is a packet present in only one of two certificates.
+type certChange struct {
+	added     bool
+	component *packet.OpaquePacket
+	packet    *packet.OpaquePacket
+}
+
+func diffSigs(changes []certChange, from, to *certComponent) []certChange {
+	known := make(map[string]bool, len(from.sigs))
+	for _, sig := range from.sigs {
+		known[packetKey(sig)] = true
+	}
+	for _, sig := range to.sigs {
+		if !known[packetKey(sig)] {
+			changes = append(changes, certChange{true, to.packet, sig})
+		}
+	}
+
+	known = make(map[string]bool, len(to.sigs))
+	for _, sig := range to.sigs {
+		known[packetKey(sig)] = true
+	}
+	for _, sig := range from.sigs {
+		if !known[packetKey(sig)] {
+			changes = append(changes, certChange{false, from.packet, sig})
+		}
+	}
+
+	return changes
+}
+
+func diffComponents(changes []certChange, from, to []certComponent) []certChange {
+	for i := range to {
+		if comp := findComponent(from, to[i].packet); comp != nil {
+			changes = diffSigs(changes, comp, &to[i])
+		} else {
+			changes = append(changes, certChange{true, to[i].packet, to[i].packet})
+			for _, sig := range to[i].sigs {
+				changes = append(changes, certChange{true, to[i].packet, sig})
+			}
+		}
+	}
+	for i := range from {
+		if findComponent(to, from[i].packet) == nil {
+			changes = append(changes, certChange{false, from[i].packet, from[i].packet})
+			for _, sig := range from[i].sigs {
+				changes = append(changes, certChange{false, from[i].packet, sig})
+			}
+		}
+	}
+	return changes
+}
+
+// diffCerts lists the packets added and removed between two certificates.
+func diffCerts(from, to *cert) []certChange {
+	var changes []certChange
+	if packetKey(from.primary.packet) == packetKey(to.primary.packet) {
+		changes = diffSigs(changes, &from.primary, &to.primary)
+	} else {
+		changes = diffComponents(changes, []certComponent{from.primary}, []certComponent{to.primary})
+	}
+	changes = diffComponents(changes, from.uids, to.uids)
+	changes = diffComponents(changes, from.subkeys, to.subkeys)
+	return changes
+}
+
+func describePacket(op *packet.OpaquePacket) string {
+	p, err := op.Parse()
+	if err != nil {
+		return fmt.Sprintf("unparsable packet (tag %v): %v", op.Tag, err)
+	}
+
+	switch p := p.(type) {
+	case *packet.PublicKey:
+		if p.IsSubkey {
+			return fmt.Sprintf("subkey %X", p.Fingerprint[:])
+		}
+		return fmt.Sprintf("primary key %X", p.Fingerprint[:])
+	case *packet.UserId:
+		return fmt.Sprintf("uid %q", p.Id)
+	case *packet.UserAttribute:
+		return "user attribute"
+	case *packet.Signature:
+		issuer := "unknown issuer"
+		if p.IssuerKeyId != nil {
+			issuer = fmt.Sprintf("%016X", *p.IssuerKeyId)
+		}
+		return fmt.Sprintf("signature type 0x%02X by %v created %v", uint8(p.SigType), issuer, p.CreationTime.UTC())
+	default:
+		return fmt.Sprintf("packet (tag %v)", op.Tag)
+	}
+}
+
+func (ch *certChange) String() string {
+	sign := "-"
+	if ch.added {
+		sign = "+"
+	}
+	if ch.packet == ch.component {
+		return sign + " " + describePacket(ch.packet)
+	}
+	return sign + " " + describePacket(ch.packet) + " on " + describePacket(ch.component)
+}
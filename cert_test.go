@@ -0,0 +1,193 @@
+package klaes
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// testPackets serializes opaque packets, given as pairs of tags and contents.
+func testPackets(t *testing.T, l ...interface{}) []byte {
+	var b bytes.Buffer
+	for i := 0; i < len(l); i += 2 {
+		p := packet.OpaquePacket{Tag: uint8(l[i].(int)), Contents: []byte(l[i+1].(string))}
+		if err := p.Serialize(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestMergePackets(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new []interface{}
+		// want is nil if the merge doesn't change anything
+		want []interface{}
+		err  bool
+	}{
+		{
+			name: "same",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1"},
+			new:  []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1"},
+		},
+		{
+			name: "subset",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1", tagUserID, "bob"},
+			new:  []interface{}{tagPublicKey, "pk", tagUserID, "bob"},
+		},
+		{
+			name: "trust packet",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "alice"},
+			new:  []interface{}{tagPublicKey, "pk", 12, "trust", tagUserID, "alice"},
+		},
+		{
+			name: "new uid",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1"},
+			new:  []interface{}{tagPublicKey, "pk", tagUserID, "bob", tagSignature, "s2"},
+			want: []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1", tagUserID, "bob", tagSignature, "s2"},
+		},
+		{
+			name: "new uid signature",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1", tagUserID, "bob"},
+			new:  []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s2", tagSignature, "s1"},
+			want: []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1", tagSignature, "s2", tagUserID, "bob"},
+		},
+		{
+			name: "new revocation",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "alice"},
+			new:  []interface{}{tagPublicKey, "pk", tagSignature, "rev"},
+			want: []interface{}{tagPublicKey, "pk", tagSignature, "rev", tagUserID, "alice"},
+		},
+		{
+			name: "new subkey",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagPublicSubkey, "sk1", tagSignature, "b1"},
+			new:  []interface{}{tagPublicKey, "pk", tagPublicSubkey, "sk2", tagSignature, "b2"},
+			want: []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagPublicSubkey, "sk1", tagSignature, "b1", tagPublicSubkey, "sk2", tagSignature, "b2"},
+		},
+		{
+			name: "same contents, different component",
+			old:  []interface{}{tagPublicKey, "pk", tagUserID, "x"},
+			new:  []interface{}{tagPublicKey, "pk", tagUserAttribute, "x"},
+			want: []interface{}{tagPublicKey, "pk", tagUserID, "x", tagUserAttribute, "x"},
+		},
+		{
+			name: "different primary key",
+			old:  []interface{}{tagPublicKey, "pk1"},
+			new:  []interface{}{tagPublicKey, "pk2"},
+			err:  true,
+		},
+		{
+			name: "signature first",
+			old:  []interface{}{tagPublicKey, "pk"},
+			new:  []interface{}{tagSignature, "s1", tagPublicKey, "pk"},
+			err:  true,
+		},
+		{
+			name: "multiple primary keys",
+			old:  []interface{}{tagPublicKey, "pk"},
+			new:  []interface{}{tagPublicKey, "pk", tagPublicKey, "pk"},
+			err:  true,
+		},
+		{
+			name: "empty",
+			old:  []interface{}{tagPublicKey, "pk"},
+			new:  []interface{}{},
+			err:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := mergePackets(testPackets(t, tc.old...), testPackets(t, tc.new...))
+			if tc.err {
+				if err == nil {
+					t.Fatal("mergePackets() succeeded, want an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("mergePackets() = %v", err)
+			}
+
+			var want []byte
+			if tc.want != nil {
+				want = testPackets(t, tc.want...)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("mergePackets() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestDiffCerts(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to []interface{}
+		// want lists changes as +/-, component contents and packet contents
+		want []string
+	}{
+		{
+			name: "same",
+			from: []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1"},
+			to:   []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1"},
+		},
+		{
+			name: "uid added",
+			from: []interface{}{tagPublicKey, "pk"},
+			to:   []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1"},
+			want: []string{"+ alice alice", "+ alice s1"},
+		},
+		{
+			name: "uid removed",
+			from: []interface{}{tagPublicKey, "pk", tagUserID, "alice", tagSignature, "s1"},
+			to:   []interface{}{tagPublicKey, "pk"},
+			want: []string{"- alice alice", "- alice s1"},
+		},
+		{
+			name: "signatures changed",
+			from: []interface{}{tagPublicKey, "pk", tagSignature, "d1", tagUserID, "alice", tagSignature, "s1"},
+			to:   []interface{}{tagPublicKey, "pk", tagSignature, "d1", tagSignature, "rev", tagUserID, "alice", tagSignature, "s2"},
+			want: []string{"+ pk rev", "+ alice s2", "- alice s1"},
+		},
+		{
+			name: "subkey replaced",
+			from: []interface{}{tagPublicKey, "pk", tagPublicSubkey, "sk1", tagSignature, "b1"},
+			to:   []interface{}{tagPublicKey, "pk", tagPublicSubkey, "sk2", tagSignature, "b2"},
+			want: []string{"+ sk2 sk2", "+ sk2 b2", "- sk1 sk1", "- sk1 b1"},
+		},
+		{
+			name: "primary key replaced",
+			from: []interface{}{tagPublicKey, "pk1", tagSignature, "d1"},
+			to:   []interface{}{tagPublicKey, "pk2"},
+			want: []string{"+ pk2 pk2", "- pk1 pk1", "- pk1 d1"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			from, err := readCert(testPackets(t, tc.from...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			to, err := readCert(testPackets(t, tc.to...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, ch := range diffCerts(from, to) {
+				sign := "-"
+				if ch.added {
+					sign = "+"
+				}
+				got = append(got, sign+" "+string(ch.component.Contents)+" "+string(ch.packet.Contents))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("diffCerts() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"github.com/emersion/klaes"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func getLogJSON(base, path string, q url.Values, v interface{}) error {
+	u := strings.TrimSuffix(base, "/") + "/log/" + path
+	if q != nil {
+		u += "?" + q.Encode()
+	}
+
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get %v: %v", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getLogEntries downloads all entries of a tree.
+func getLogEntries(base string, treeSize uint64) ([]klaes.LogEntry, error) {
+	var entries []klaes.LogEntry
+	for uint64(len(entries)) < treeSize {
+		var page []klaes.LogEntry
+		q := url.Values{}
+		q.Set("start", fmt.Sprint(len(entries)))
+		q.Set("end", fmt.Sprint(treeSize))
+		if err := getLogJSON(base, "entries", q, &page); err != nil {
+			return nil, err
+		} else if len(page) == 0 {
+			return nil, fmt.Errorf("log entries missing from %v", len(entries))
+		}
+		entries = append(entries, page...)
+	}
+	return entries, nil
+}
+
+// getHKPKey fetches the binary key served over HKP for a fingerprint. Nil is
+// returned if the key isn't served.
+func getHKPKey(base, fingerprint string) ([]byte, error) {
+	q := url.Values{}
+	q.Set("op", "get")
+	q.Set("options", "mr")
+	q.Set("search", "0x"+fingerprint)
+	u := strings.TrimSuffix(base, "/") + hkp.Base + "/lookup?" + q.Encode()
+
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %v: %v", u, resp.Status)
+	}
+
+	block, err := armor.Decode(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(block.Body)
+}
+
+// auditLog checks the transparency log of the klaes instance at base. The
+// signed tree head is verified against pubHex, and against the tree head
+// saved in statePath by the previous run, if any, with a consistency proof.
+//
+// If fingerprint isn't empty, all log entries are downloaded and checked
+// against the tree head, the key's entries are printed and the key served
+// over HKP is checked against the latest one.
+func auditLog(base, pubHex, statePath, fingerprint string) error {
+	pub, err := hex.DecodeString(pubHex)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid log public key")
+	}
+
+	var sth klaes.SignedTreeHead
+	if err := getLogJSON(base, "sth", nil, &sth); err != nil {
+		return err
+	}
+	if err := sth.Verify(pub); err != nil {
+		return err
+	}
+
+	if statePath != "" {
+		b, err := ioutil.ReadFile(statePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		} else if err == nil {
+			var prev klaes.SignedTreeHead
+			if err := json.Unmarshal(b, &prev); err != nil {
+				return fmt.Errorf("invalid log state: %v", err)
+			}
+
+			var proof klaes.ConsistencyProof
+			if prev.TreeSize < sth.TreeSize {
+				q := url.Values{}
+				q.Set("first", fmt.Sprint(prev.TreeSize))
+				q.Set("second", fmt.Sprint(sth.TreeSize))
+				if err := getLogJSON(base, "consistency", q, &proof); err != nil {
+					return err
+				}
+			}
+			if err := klaes.VerifyConsistency(prev.TreeSize, sth.TreeSize, prev.RootHash, sth.RootHash, proof.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if fingerprint != "" {
+		fingerprint = strings.ToUpper(strings.TrimPrefix(fingerprint, "0x"))
+
+		entries, err := getLogEntries(base, sth.TreeSize)
+		if err != nil {
+			return err
+		}
+		if err := sth.VerifyEntries(entries); err != nil {
+			return err
+		}
+
+		var latest *klaes.LogEntry
+		for i, e := range entries {
+			if e.Fingerprint != fingerprint {
+				continue
+			}
+			latest = &entries[i]
+
+			t := time.Unix(0, e.Timestamp*int64(time.Millisecond))
+			if e.Deleted {
+				fmt.Printf("%v\t%v\tdeleted\n", e.Index, t)
+			} else {
+				fmt.Printf("%v\t%v\t%x\n", e.Index, t, e.Digest)
+			}
+		}
+
+		b, err := getHKPKey(base, fingerprint)
+		if err != nil {
+			return err
+		}
+		switch {
+		case b == nil:
+			fmt.Printf("Key %v is not served\n", fingerprint)
+		case latest == nil:
+			return fmt.Errorf("key %v is served but has no log entry", fingerprint)
+		case latest.Deleted:
+			return fmt.Errorf("key %v is served but was deleted in log entry %v", fingerprint, latest.Index)
+		case !bytes.Equal(klaes.KeyDigest(b), latest.Digest):
+			return fmt.Errorf("key %v doesn't match log entry %v", fingerprint, latest.Index)
+		default:
+			fmt.Printf("Key %v matches log entry %v\n", fingerprint, latest.Index)
+		}
+	}
+
+	if statePath != "" {
+		b, err := json.Marshal(&sth)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(statePath, b, 0644); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Verified tree of size %v with root %x\n", sth.TreeSize, sth.RootHash)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/klaes"
+)
+
+const ctlTimeout = 30 * time.Second
+
+// logRing keeps the last log lines in memory, so that they can be retrieved
+// over the control socket.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	size  int
+}
+
+func (lr *logRing) Write(b []byte) (int, error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		lr.lines = append(lr.lines, line)
+	}
+	if len(lr.lines) > lr.size {
+		lr.lines = append([]string(nil), lr.lines[len(lr.lines)-lr.size:]...)
+	}
+	return len(b), nil
+}
+
+func (lr *logRing) tail(n int) []string {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if n > len(lr.lines) {
+		n = len(lr.lines)
+	}
+	return append([]string(nil), lr.lines[len(lr.lines)-n:]...)
+}
+
+// ctlServer handles commands sent over the control socket. Each connection
+// carries a single command line, the reply is written back before the
+// connection is closed. Failed commands reply with a line starting with
+// "error: ".
+type ctlServer struct {
+	s     *klaes.Server
+	logs  *logRing
+	start time.Time
+}
+
+func (cs *ctlServer) serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go cs.handle(c)
+	}
+}
+
+func (cs *ctlServer) handle(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ctlTimeout))
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	if err := cs.exec(c, strings.Fields(line)); err != nil {
+		fmt.Fprintf(c, "error: %v\n", err)
+	}
+}
+
+func (cs *ctlServer) exec(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command")
+	}
+
+	switch args[0] {
+	case "status":
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+
+		fmt.Fprintf(w, "uptime: %v\n", time.Since(cs.start).Round(time.Second))
+		fmt.Fprintf(w, "read-only: %v\n", cs.s.ReadOnly())
+		fmt.Fprintf(w, "degraded: %v\n", cs.s.Degraded())
+		if n, err := cs.s.KeyCount(); err != nil {
+			fmt.Fprintf(w, "keys: %v\n", err)
+		} else {
+			fmt.Fprintf(w, "keys: %v\n", n)
+		}
+		fmt.Fprintf(w, "goroutines: %v\n", runtime.NumGoroutine())
+		fmt.Fprintf(w, "heap: %v bytes\n", ms.HeapAlloc)
+	case "read-only":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			return fmt.Errorf("usage: read-only on|off")
+		}
+		cs.s.SetReadOnly(args[1] == "on")
+		log.Printf("Read-only mode turned %v", args[1])
+	case "flush":
+		cs.s.FlushCache()
+	case "gc":
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		debug.FreeOSMemory()
+		runtime.ReadMemStats(&after)
+		fmt.Fprintf(w, "heap: %v -> %v bytes\n", before.HeapAlloc, after.HeapAlloc)
+	case "errors":
+		n := 20
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+				return fmt.Errorf("invalid line count: %v", args[1])
+			}
+		}
+		for _, line := range cs.logs.tail(n) {
+			fmt.Fprintln(w, line)
+		}
+	default:
+		return fmt.Errorf("unknown command: %v", args[0])
+	}
+	return nil
+}
+
+// runCtl sends a command to the control socket of a running server and
+// copies the reply to stdout.
+func runCtl(path string, args []string) error {
+	if path == "" {
+		return fmt.Errorf("missing -ctl-socket")
+	}
+
+	c, err := net.DialTimeout("unix", path, ctlTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ctlTimeout))
+
+	if _, err := fmt.Fprintln(c, strings.Join(args, " ")); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(c)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.HasPrefix(line, "error: ") {
+			return fmt.Errorf("%v", strings.TrimSpace(strings.TrimPrefix(line, "error: ")))
+		}
+		os.Stdout.WriteString(line)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
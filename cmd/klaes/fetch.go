@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"github.com/emersion/go-openpgp-wkd"
+	"golang.org/x/crypto/openpgp"
+)
+
+// fetchVKS looks up a key on a Verifying Keyserver, such as
+// keys.openpgp.org.
+func fetchVKS(host, query string) (openpgp.EntityList, error) {
+	u := url.URL{Scheme: "https", Host: host}
+	if strings.Contains(query, "@") {
+		u.Path = "/vks/v1/by-email/" + url.PathEscape(query)
+	} else {
+		search := strings.ToUpper(strings.TrimPrefix(query, "0x"))
+		if len(search) == 40 {
+			u.Path = "/vks/v1/by-fingerprint/" + search
+		} else {
+			u.Path = "/vks/v1/by-keyid/" + search
+		}
+	}
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, hkp.ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vks: failed to get key: %v", resp.Status)
+	}
+
+	return openpgp.ReadArmoredKeyRing(resp.Body)
+}
+
+// fetchKeys retrieves the keys matching query, a fingerprint, key ID or
+// email address, from source. The source is "wkd", "hkp:<url>" or
+// "vks:<host>".
+func fetchKeys(source, query string) (openpgp.EntityList, error) {
+	isEmail := strings.Contains(query, "@")
+	if !isEmail && !strings.HasPrefix(query, "0x") {
+		query = "0x" + query
+	}
+
+	var el openpgp.EntityList
+	var err error
+	switch {
+	case source == "wkd":
+		if !isEmail {
+			return nil, fmt.Errorf("WKD lookups require an email address")
+		}
+		el, err = wkd.Discover(query)
+	case strings.HasPrefix(source, "hkp:"):
+		c := hkp.Client{Host: strings.TrimPrefix(source, "hkp:")}
+		el, err = c.Get(&hkp.LookupRequest{Search: query, Exact: true})
+	case strings.HasPrefix(source, "vks:"):
+		el, err = fetchVKS(strings.TrimPrefix(source, "vks:"), query)
+	default:
+		return nil, fmt.Errorf("unknown source %q", source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only keep keys actually matching the query, the remote source might
+	// return more than asked for
+	var keys openpgp.EntityList
+	keyIDSearch := hkp.ParseKeyIDSearch(query)
+	for _, e := range el {
+		ok := false
+		if isEmail {
+			for _, ident := range e.Identities {
+				if strings.EqualFold(ident.UserId.Email, query) {
+					ok = true
+					break
+				}
+			}
+		} else if fingerprint := keyIDSearch.Fingerprint(); fingerprint != nil {
+			ok = bytes.Equal(fingerprint[:], e.PrimaryKey.Fingerprint[:])
+		} else if keyID := keyIDSearch.KeyId(); keyID != nil {
+			ok = *keyID == e.PrimaryKey.KeyId
+		} else if keyID := keyIDSearch.KeyIdShort(); keyID != nil {
+			ok = *keyID == uint32(e.PrimaryKey.KeyId)
+		}
+		if ok {
+			keys = append(keys, e)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no matching key found")
+	}
+	return keys, nil
+}
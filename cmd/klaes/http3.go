@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server creates an HTTP/3 server listening on the UDP address addr.
+func newHTTP3Server(addr, certFile, keyFile string, h http.Handler) (*http3.Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http3.Server{
+		Addr:    addr,
+		Handler: h,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}),
+	}, nil
+}
+
+// advertiseHTTP3 wraps a handler to announce the HTTP/3 server with the
+// Alt-Svc header. Until the server is listening, nothing is announced.
+func advertiseHTTP3(srv *http3.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.SetQUICHeaders(w.Header())
+		h.ServeHTTP(w, r)
+	})
+}
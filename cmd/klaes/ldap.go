@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapAttributes are the attributes read by klaes.Server.SyncDirectory.
+var ldapAttributes = []string{"mail", "proxyAddresses", "userAccountControl"}
+
+// ldapPageSize is below the default MaxPageSize of Active Directory.
+const ldapPageSize = 500
+
+type ldapConfig struct {
+	url      string
+	bindDN   string
+	password string
+	baseDN   string
+	filter   string
+}
+
+// searchLDAP lists the accounts of an LDAP directory, e.g. Active Directory,
+// and returns them in the LDIF format expected by klaes.Server.SyncDirectory.
+func searchLDAP(cfg *ldapConfig) (io.Reader, error) {
+	conn, err := ldap.DialURL(cfg.url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(time.Minute)
+
+	if cfg.bindDN != "" {
+		if err := conn.Bind(cfg.bindDN, cfg.password); err != nil {
+			return nil, fmt.Errorf("failed to bind: %v", err)
+		}
+	}
+
+	req := ldap.NewSearchRequest(
+		cfg.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		cfg.filter, ldapAttributes, nil,
+	)
+	res, err := conn.SearchWithPaging(req, ldapPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search directory: %v", err)
+	}
+
+	// Values are base64-encoded, they may contain any character
+	var b bytes.Buffer
+	for _, entry := range res.Entries {
+		fmt.Fprintf(&b, "dn:: %v\n", base64.StdEncoding.EncodeToString([]byte(entry.DN)))
+		for _, attr := range entry.Attributes {
+			for _, v := range attr.Values {
+				fmt.Fprintf(&b, "%v:: %v\n", attr.Name, base64.StdEncoding.EncodeToString([]byte(v)))
+			}
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	return &b, nil
+}
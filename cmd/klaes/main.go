@@ -2,11 +2,19 @@ package main
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/emersion/klaes"
 	_ "github.com/lib/pq"
@@ -15,35 +23,410 @@ import (
 	"golang.org/x/crypto/openpgp/packet"
 )
 
+func parseFingerprint(s string) [20]byte {
+	var fingerprint [20]byte
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil || len(b) != len(fingerprint) {
+		log.Fatalf("Invalid fingerprint: %v", s)
+	}
+	copy(fingerprint[:], b)
+	return fingerprint
+}
+
+func parsePolicy(s string) klaes.Policy {
+	var p klaes.Policy
+	if s == "" {
+		return p
+	}
+	for _, opt := range strings.Split(s, ",") {
+		switch opt {
+		case "withhold-expired":
+			p.WithholdExpired = true
+		case "withhold-revoked":
+			p.WithholdRevoked = true
+		case "include-on-request":
+			p.IncludeOnRequest = true
+		default:
+			log.Fatalf("Unknown policy option: %v", opt)
+		}
+	}
+	return p
+}
+
+func parseWKDDomains(s string) map[string]klaes.WKDDomain {
+	if s == "" {
+		return nil
+	}
+	domains := make(map[string]klaes.WKDDomain)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		var d klaes.WKDDomain
+		if len(parts) == 2 {
+			for _, opt := range strings.Split(parts[1], "+") {
+				switch opt {
+				case "direct":
+					d.Methods |= klaes.WKDDirect
+				case "advanced":
+					d.Methods |= klaes.WKDAdvanced
+				case "strip-plus-tag":
+					d.StripPlusTag = true
+				default:
+					log.Fatalf("Unknown WKD domain option: %v", opt)
+				}
+			}
+		}
+		domains[strings.ToLower(parts[0])] = d
+	}
+	return domains
+}
+
+func logScrubError(msg string) {
+	log.Printf("Corrupted data: %v", msg)
+}
+
+func logIngestError(name string, err error) {
+	log.Printf("Failed to ingest message %v: %v", name, err)
+}
+
 func main() {
 	var (
-		armored   bool
-		addr      string
-		sqlDriver string
-		sqlSource string
+		armored     bool
+		holdClaimed bool
+		proxyProto  bool
+		dirOnly     bool
+		force       bool
+		addr        string
+		hkpPolicy   string
+		wkdPolicy   string
+		wkdDomains  string
+		mtaSocket   string
+		ctlSocket   string
+		logKey      string
+		logState    string
+		mtaDomains  string
+		packetsKey  string
+		oldKeys     string
+		sendmail    string
+		notifyFrom  string
+		scrubEvery  time.Duration
+		revalEvery  time.Duration
+		workers     int
+		retention   time.Duration
+		tlsCert     string
+		tlsKey      string
+		http3       bool
+		cacheSize   int
+		timeout     time.Duration
+		maxConns    int
+		ldapURL     string
+		ldapBindDN  string
+		ldapPass    string
+		ldapBaseDN  string
+		ldapFilter  string
+		dirEvery    time.Duration
+		keyMaxAge   time.Duration
+		lookupAge   time.Duration
+		source      string
+		maildir     string
+		baseURL     string
+		locale      string
+		sqlDriver   string
+		sqlSource   string
 	)
 	flag.BoolVar(&armored, "armor", false, "import, export: use an armored keyring")
+	flag.BoolVar(&holdClaimed, "hold-claimed", false, "import: hold keys claiming an email address used by another verified key")
+	flag.StringVar(&sendmail, "sendmail", "", "path to sendmail, used to notify owners of verified keys when their email address is claimed")
+	flag.StringVar(&notifyFrom, "notify-from", "", "sender address of notifications")
+	flag.BoolVar(&force, "force", false, "sync-directory: accept an empty or much smaller directory")
+	flag.StringVar(&ldapURL, "ldap-url", "", "sync-directory, serve: LDAP directory to sync email addresses from instead of reading LDIF from stdin, e.g. ldaps://dc.example.org")
+	flag.StringVar(&ldapBindDN, "ldap-bind-dn", "", "sync-directory, serve: DN to bind to the LDAP directory as (anonymous if empty)")
+	flag.StringVar(&ldapPass, "ldap-password-file", "", "sync-directory, serve: file containing the LDAP bind password")
+	flag.StringVar(&ldapBaseDN, "ldap-base-dn", "", "sync-directory, serve: LDAP base DN of accounts")
+	flag.StringVar(&ldapFilter, "ldap-filter", "(objectClass=person)", "sync-directory, serve: LDAP filter of accounts")
+	flag.DurationVar(&dirEvery, "directory-sync-interval", time.Hour, "serve: interval between syncs from -ldap-url")
+	flag.BoolVar(&dirOnly, "directory-only", false, "import, serve: reject keys with email addresses missing from the directory")
+	flag.StringVar(&source, "source", "wkd", "fetch: remote source (wkd, hkp:<url> or vks:<host>)")
 	flag.StringVar(&addr, "addr", ":8080", "serve: listening address")
+	flag.BoolVar(&proxyProto, "proxy-protocol", false, "serve: expect a HAProxy PROXY protocol header on incoming connections")
+	flag.StringVar(&baseURL, "base-url", "", "serve: public URL of the server, endpoints are served under its path")
+	flag.StringVar(&locale, "locale", "en", "import, serve: default language of the web UI, and language of notifications")
+	flag.StringVar(&tlsCert, "tls-cert", "", "serve: TLS certificate file, enables HTTPS")
+	flag.StringVar(&tlsKey, "tls-key", "", "serve: TLS private key file")
+	flag.BoolVar(&http3, "http3", false, "serve: also serve HTTP/3 on the same UDP port, requires -tls-cert")
+	flag.DurationVar(&keyMaxAge, "key-max-age", 0, "serve: cache lifetime of HKP lookups by fingerprint (no cache headers if zero)")
+	flag.DurationVar(&lookupAge, "lookup-max-age", 0, "serve: cache lifetime of other lookups and searches (no cache headers if zero)")
+	flag.StringVar(&hkpPolicy, "hkp-policy", "", "serve: comma-separated HKP serving policy (withhold-expired, withhold-revoked, include-on-request)")
+	flag.StringVar(&wkdPolicy, "wkd-policy", "", "serve: comma-separated WKD serving policy")
+	flag.StringVar(&wkdDomains, "wkd-domains", "", "serve: comma-separated WKD domains, each optionally followed by =options (direct, advanced, strip-plus-tag) joined with +")
+	flag.StringVar(&mtaSocket, "mta-socket", "", "serve: unix socket path for the mail server integration API")
+	flag.StringVar(&mtaDomains, "mta-domains", "", "serve: comma-separated domains hosted by the mail server")
+	flag.StringVar(&ctlSocket, "ctl-socket", "", "serve, ctl: unix socket path for the control interface")
+	flag.StringVar(&logKey, "log-key-file", "", "serve, log-public-key: file containing a hex-encoded Ed25519 seed signing the transparency log")
+	flag.StringVar(&logState, "log-state", "", "audit: file keeping the last verified tree head")
+	flag.StringVar(&packetsKey, "packets-key-file", "", "file containing a hex-encoded AES key used to encrypt stored packets, existing packets need to be converted with reseal")
+	flag.StringVar(&oldKeys, "old-packets-key-file", "", "file containing hex-encoded AES keys previously used to encrypt stored packets, one per line")
+	flag.DurationVar(&scrubEvery, "scrub-interval", 0, "serve: interval between checks of stored packets (disabled if zero)")
+	flag.DurationVar(&revalEvery, "revalidate-interval", 24*time.Hour, "serve: interval between key status recomputations (disabled if zero)")
+	flag.IntVar(&workers, "submission-workers", 1, "serve: number of workers importing queued submissions")
+	flag.DurationVar(&retention, "submission-retention", 7*24*time.Hour, "serve: how long the status of finished submissions is kept (forever if zero)")
+	flag.IntVar(&cacheSize, "cache-size", 1000, "serve: number of key lookups cached to be served while the database is unavailable")
+	flag.DurationVar(&timeout, "query-timeout", 10*time.Second, "how long a lookup or import may wait for the database before failing")
+	flag.StringVar(&maildir, "maildir", "", "serve: Maildir to watch for key submissions")
 	flag.StringVar(&sqlDriver, "sql-driver", "postgres", "SQL driver name")
-	flag.StringVar(&sqlSource, "sql-source", "host=/run/postgresql dbname=klaes", "SQL data source name")
+	flag.StringVar(&sqlSource, "sql-source", "host=/run/postgresql dbname=klaes connect_timeout=10", "SQL data source name")
+	flag.IntVar(&maxConns, "sql-max-conns", 20, "maximum number of open database connections (unlimited if zero)")
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "ctl":
+		if err := runCtl(ctlSocket, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "audit":
+		if err := auditLog(flag.Arg(1), flag.Arg(2), logState, flag.Arg(3)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	db, err := sql.Open(sqlDriver, sqlSource)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	// Don't let a stuck database accumulate connections, and replace
+	// connections which may have been silently dropped by a firewall
+	db.SetMaxOpenConns(maxConns)
+	db.SetConnMaxLifetime(30 * time.Minute)
+	db.SetConnMaxIdleTime(5 * time.Minute)
 
 	if err := db.Ping(); err != nil {
 		log.Fatal(err)
 	}
 
 	s := klaes.NewServer(db)
+	s.HoldClaimedKeys = holdClaimed
+	if packetsKey != "" {
+		b, err := ioutil.ReadFile(packetsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			log.Fatalf("Invalid packets key: %v", err)
+		}
+		if err := s.EncryptPackets(key); err != nil {
+			log.Fatalf("Invalid packets key: %v", err)
+		}
+	}
+	if oldKeys != "" {
+		b, err := ioutil.ReadFile(oldKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, line := range strings.Fields(string(b)) {
+			key, err := hex.DecodeString(line)
+			if err != nil {
+				log.Fatalf("Invalid old packets key: %v", err)
+			}
+			if err := s.DecryptPackets(key); err != nil {
+				log.Fatalf("Invalid old packets key: %v", err)
+			}
+		}
+	}
+	var ldapCfg *ldapConfig
+	if ldapURL != "" {
+		ldapCfg = &ldapConfig{url: ldapURL, bindDN: ldapBindDN, baseDN: ldapBaseDN, filter: ldapFilter}
+		if ldapPass != "" {
+			b, err := ioutil.ReadFile(ldapPass)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ldapCfg.password = strings.TrimRight(string(b), "\r\n")
+		}
+	}
+	if logKey != "" {
+		b, err := ioutil.ReadFile(logKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			log.Fatalf("Invalid log key: %v", err)
+		}
+		if err := s.SignLog(seed); err != nil {
+			log.Fatalf("Invalid log key: %v", err)
+		}
+	}
+	if baseURL != "" {
+		if _, err := url.Parse(baseURL); err != nil {
+			log.Fatalf("Invalid base URL: %v", err)
+		}
+	}
+	s.BaseURL = baseURL
+	s.DefaultLocale = locale
+	s.SetCacheSize(cacheSize)
+	s.SetQueryTimeout(timeout)
+	s.CachePolicy = klaes.CachePolicy{KeyMaxAge: keyMaxAge, LookupMaxAge: lookupAge}
+	s.DirectoryOnly = dirOnly
+	s.HKPPolicy = parsePolicy(hkpPolicy)
+	s.WKDPolicy = parsePolicy(wkdPolicy)
+	s.WKDDomains = parseWKDDomains(wkdDomains)
+	s.EmailClaimed = func(email string, claimed, by [20]byte) {
+		log.Printf("Key %X claims email address %v already used by verified key %X\n", by[:], email, claimed[:])
+		if sendmail == "" {
+			return
+		}
+		subject, body := s.ClaimNotice(email, claimed, by, s.HoldClaimedKeys)
+		if err := sendClaimNotice(sendmail, notifyFrom, email, subject, body); err != nil {
+			log.Printf("Failed to notify owner of key %X: %v", claimed[:], err)
+		}
+	}
 
 	switch flag.Arg(0) {
 	case "serve", "":
+		if http3 && tlsCert == "" {
+			log.Fatal("-http3 requires -tls-cert")
+		}
+
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if proxyProto {
+			ln = proxyListener{ln}
+		}
+
+		if scrubEvery > 0 {
+			go func() {
+				for range time.Tick(scrubEvery) {
+					if err := s.Scrub(logScrubError); err != nil {
+						log.Printf("Failed to scrub stored packets: %v", err)
+					}
+				}
+			}()
+		}
+
+		if revalEvery > 0 {
+			go func() {
+				for range time.Tick(revalEvery) {
+					if n, err := s.Revalidate(logScrubError); err != nil {
+						log.Printf("Failed to revalidate keys: %v", err)
+					} else if n > 0 {
+						log.Printf("Updated the status of %v keys", n)
+					}
+				}
+			}()
+		}
+
+		for i := 0; i < workers; i++ {
+			go func() {
+				for range time.Tick(time.Second) {
+					if _, err := s.ProcessSubmissions(); err != nil {
+						log.Printf("Failed to process submissions: %v", err)
+					}
+				}
+			}()
+		}
+
+		if retention > 0 {
+			go func() {
+				for range time.Tick(time.Hour) {
+					if n, err := s.PurgeSubmissions(retention); err != nil {
+						log.Printf("Failed to purge submissions: %v", err)
+					} else if n > 0 {
+						log.Printf("Purged %v finished submissions", n)
+					}
+				}
+			}()
+		}
+
+		if ldapCfg != nil && dirEvery > 0 {
+			go func() {
+				for range time.Tick(dirEvery) {
+					if s.ReadOnly() {
+						continue
+					}
+					r, err := searchLDAP(ldapCfg)
+					if err != nil {
+						log.Printf("Failed to read LDAP directory: %v", err)
+						continue
+					}
+					fingerprints, err := s.SyncDirectory(r, false)
+					if err != nil {
+						log.Printf("Failed to sync directory: %v", err)
+						continue
+					}
+					for _, fingerprint := range fingerprints {
+						log.Printf("Key %X has email addresses missing from the directory", fingerprint[:])
+					}
+				}
+			}()
+		}
+
+		if maildir != "" {
+			go func() {
+				for range time.Tick(time.Minute) {
+					if s.ReadOnly() {
+						continue
+					}
+					if _, err := s.IngestMaildir(maildir, logIngestError); err != nil {
+						log.Printf("Failed to ingest Maildir: %v", err)
+					}
+				}
+			}()
+		}
+
+		if mtaSocket != "" {
+			os.Remove(mtaSocket)
+			mtaLn, err := net.Listen("unix", mtaSocket)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			var domains []string
+			if mtaDomains != "" {
+				domains = strings.Split(mtaDomains, ",")
+			}
+			go func() {
+				log.Fatal(http.Serve(mtaLn, s.IntegrationHandler(domains)))
+			}()
+		}
+
+		if ctlSocket != "" {
+			logs := &logRing{size: 1000}
+			log.SetOutput(io.MultiWriter(os.Stderr, logs))
+
+			os.Remove(ctlSocket)
+			ctlLn, err := net.Listen("unix", ctlSocket)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			cs := &ctlServer{s: s, logs: logs, start: time.Now()}
+			go func() {
+				log.Fatal(cs.serve(ctlLn))
+			}()
+		}
+
+		var h http.Handler = s
+		if http3 {
+			h3, err := newHTTP3Server(addr, tlsCert, tlsKey, s)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go func() {
+				log.Fatal(h3.ListenAndServe())
+			}()
+			h = advertiseHTTP3(h3, s)
+		}
+
 		log.Println("Server listing on address", addr)
-		log.Fatal(http.ListenAndServe(addr, s))
+		if tlsCert != "" {
+			log.Fatal(http.ServeTLS(ln, h, tlsCert, tlsKey))
+		}
+		log.Fatal(http.Serve(ln, h))
 	case "import":
 		var r io.Reader = os.Stdin
 		if armored {
@@ -71,6 +454,25 @@ func main() {
 				log.Fatal(err)
 			}
 		}
+	case "fetch":
+		el, err := fetchKeys(source, flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, e := range el {
+			log.Printf("Importing key %X...\n", e.PrimaryKey.Fingerprint[:])
+
+			if err := s.Import(e); err != nil {
+				log.Fatal(err)
+			}
+		}
+	case "ingest-maildir":
+		n, err := s.IngestMaildir(flag.Arg(1), logIngestError)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Processed %v messages", n)
 	case "export":
 		var w io.Writer = os.Stdout
 		if armored {
@@ -99,6 +501,119 @@ func main() {
 		if err := <-done; err != nil {
 			log.Fatal(err)
 		}
+	case "sync-directory":
+		var r io.Reader = os.Stdin
+		if ldapCfg != nil {
+			if r, err = searchLDAP(ldapCfg); err != nil {
+				log.Fatalf("Failed to read LDAP directory: %v", err)
+			}
+		}
+		fingerprints, err := s.SyncDirectory(r, force)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, fingerprint := range fingerprints {
+			fmt.Printf("%X\n", fingerprint[:])
+		}
+	case "revalidate":
+		n, err := s.Revalidate(logScrubError)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Updated the status of %v keys", n)
+	case "scrub":
+		if err := s.Scrub(logScrubError); err != nil {
+			log.Fatal(err)
+		}
+	case "reseal":
+		if err := s.Reseal(); err != nil {
+			log.Fatal(err)
+		}
+	case "revoke":
+		fingerprint, err := s.Revoke(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Revoked key %X\n", fingerprint[:])
+	case "release":
+		if err := s.Release(parseFingerprint(flag.Arg(1))); err != nil {
+			log.Fatal(err)
+		}
+	case "lock":
+		token, err := s.Lock(parseFingerprint(flag.Arg(1)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+	case "unlock":
+		if err := s.Unlock(parseFingerprint(flag.Arg(1))); err != nil {
+			log.Fatal(err)
+		}
+	case "delete":
+		if err := s.Delete(parseFingerprint(flag.Arg(1))); err != nil {
+			log.Fatal(err)
+		}
+	case "group":
+		if err := s.SetGroup(flag.Arg(1), flag.Args()[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "keyring":
+		var emails []string
+		for _, arg := range flag.Args()[1:] {
+			if strings.HasPrefix(arg, "group:") {
+				members, err := s.Group(strings.TrimPrefix(arg, "group:"))
+				if err != nil {
+					log.Fatal(err)
+				} else if len(members) == 0 {
+					log.Fatalf("Unknown group: %v", arg)
+				}
+				emails = append(emails, members...)
+			} else {
+				emails = append(emails, arg)
+			}
+		}
+
+		el, missing, err := s.Keyring(emails)
+		if err != nil {
+			log.Fatal(err)
+		} else if len(missing) > 0 {
+			log.Fatalf("No current key for: %v", strings.Join(missing, ", "))
+		}
+
+		if err := klaes.WriteKeyring(os.Stdout, el); err != nil {
+			log.Fatal(err)
+		}
+	case "log-public-key":
+		pub := s.LogPublicKey()
+		if pub == nil {
+			log.Fatal("Missing -log-key-file")
+		}
+		fmt.Printf("%x\n", []byte(pub))
+	case "versions":
+		versions, err := s.KeyVersions(parseFingerprint(flag.Arg(1)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, v := range versions {
+			fmt.Printf("%v\t%v\n", v.ID, v.CreationTime)
+		}
+	case "diff":
+		from, err := strconv.Atoi(flag.Arg(1))
+		if err != nil {
+			log.Fatalf("Invalid version: %v", err)
+		}
+		to, err := strconv.Atoi(flag.Arg(2))
+		if err != nil {
+			log.Fatalf("Invalid version: %v", err)
+		}
+
+		changes, err := s.DiffKeyVersions(from, to)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, ch := range changes {
+			fmt.Println(ch)
+		}
 	default:
 		log.Fatal("Unknown command")
 	}
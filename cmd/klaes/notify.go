@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// sendClaimNotice mails a notice composed by Server.ClaimNotice to the owner
+// of a verified key with sendmail(8). If from is empty, sendmail picks the
+// sender.
+func sendClaimNotice(sendmail, from, email, subject, body string) error {
+	to, err := mail.ParseAddress(email)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %v", email, err)
+	}
+
+	var b bytes.Buffer
+	if from != "" {
+		fmt.Fprintf(&b, "From: %v\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %v\r\n", to.Address)
+	fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	cmd := exec.Command(sendmail, "-i", "--", to.Address)
+	cmd.Stdin = &b
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v: %s", sendmail, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyHeaderTimeout = 10 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections prefixed with a HAProxy PROXY protocol
+// v1 or v2 header, and reports the client address found in the header as
+// the remote address.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads the PROXY header lazily, so that a slow client doesn't
+// block the accept loop.
+type proxyConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("Invalid PROXY header from %v: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY header. A nil address is returned if the
+// header doesn't carry one (e.g. health checks from the proxy itself).
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(br)
+	}
+	return readProxyHeaderV1(br)
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("missing PROXY v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("missing PROXY v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed PROXY v1 header")
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("malformed PROXY v1 source address")
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	l := binary.BigEndian.Uint16(hdr[14:16])
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %v", verCmd>>4)
+	}
+	switch verCmd & 0xF {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %v", verCmd&0xF)
+	}
+
+	switch fam >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("truncated PROXY v2 IPv4 addresses")
+		}
+		ip := net.IP(payload[0:4])
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("truncated PROXY v2 IPv6 addresses")
+		}
+		ip := net.IP(payload[0:16])
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX: no usable client address
+		return nil, nil
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func proxyV2Header(verCmd, fam byte, payload []byte) string {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(payload)))
+	return string(proxyV2Signature) + string([]byte{verCmd, fam}) + string(l[:]) + string(payload)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{
+		192, 0, 2, 1, // source
+		198, 51, 100, 1, // destination
+		0x30, 0x39, // source port
+		0x01, 0xBB, // destination port
+	}
+	ipv6 := make([]byte, 36)
+	ipv6[0], ipv6[1], ipv6[15] = 0x20, 0x01, 1
+	ipv6[32], ipv6[33] = 0x30, 0x39
+
+	tests := []struct {
+		name string
+		in   string
+		// addr is empty if no address is expected
+		addr string
+		err  bool
+	}{
+		{
+			name: "v1 TCP4",
+			in:   "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n",
+			addr: "192.0.2.1:12345",
+		},
+		{
+			name: "v1 TCP6",
+			in:   "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n",
+			addr: "[2001:db8::1]:12345",
+		},
+		{
+			name: "v1 UNKNOWN",
+			in:   "PROXY UNKNOWN\r\n",
+		},
+		{
+			name: "v1 missing CRLF",
+			in:   "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n",
+			err:  true,
+		},
+		{
+			name: "v1 invalid address",
+			in:   "PROXY TCP4 192.0.2 198.51.100.1 12345 443\r\n",
+			err:  true,
+		},
+		{
+			name: "v1 invalid port",
+			in:   "PROXY TCP4 192.0.2.1 198.51.100.1 123456 443\r\n",
+			err:  true,
+		},
+		{
+			name: "v1 missing fields",
+			in:   "PROXY TCP4 192.0.2.1\r\n",
+			err:  true,
+		},
+		{
+			name: "v1 unsupported protocol",
+			in:   "PROXY UDP4 192.0.2.1 198.51.100.1 12345 443\r\n",
+			err:  true,
+		},
+		{
+			name: "no header",
+			in:   "GET / HTTP/1.1\r\n",
+			err:  true,
+		},
+		{
+			name: "too long",
+			in:   "PROXY " + strings.Repeat("A", 200) + "\r\n",
+			err:  true,
+		},
+		{
+			name: "v2 IPv4",
+			in:   proxyV2Header(0x21, 0x11, ipv4),
+			addr: "192.0.2.1:12345",
+		},
+		{
+			name: "v2 IPv6",
+			in:   proxyV2Header(0x21, 0x21, ipv6),
+			addr: "[2001::1]:12345",
+		},
+		{
+			name: "v2 TLVs",
+			in:   proxyV2Header(0x21, 0x11, append(append([]byte(nil), ipv4...), 0x04, 0x00, 0x01, 0x00)),
+			addr: "192.0.2.1:12345",
+		},
+		{
+			name: "v2 LOCAL",
+			in:   proxyV2Header(0x20, 0x00, nil),
+		},
+		{
+			name: "v2 UNIX",
+			in:   proxyV2Header(0x21, 0x31, make([]byte, 216)),
+		},
+		{
+			name: "v2 unsupported version",
+			in:   proxyV2Header(0x11, 0x11, ipv4),
+			err:  true,
+		},
+		{
+			name: "v2 unsupported command",
+			in:   proxyV2Header(0x22, 0x11, ipv4),
+			err:  true,
+		},
+		{
+			name: "v2 truncated addresses",
+			in:   proxyV2Header(0x21, 0x11, ipv4[:8]),
+			err:  true,
+		},
+		{
+			name: "v2 truncated payload",
+			in:   proxyV2Header(0x21, 0x11, make([]byte, 100))[:30],
+			err:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			const body = "GET / HTTP/1.1\r\n"
+			br := bufio.NewReader(strings.NewReader(tc.in + body))
+
+			addr, err := readProxyHeader(br)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("readProxyHeader() = %v, want an error", addr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("readProxyHeader() = %v", err)
+			}
+
+			if tc.addr == "" {
+				if addr != nil {
+					t.Errorf("readProxyHeader() = %v, want no address", addr)
+				}
+			} else if addr == nil || addr.String() != tc.addr {
+				t.Errorf("readProxyHeader() = %v, want %v", addr, tc.addr)
+			}
+
+			if rest, _ := ioutil.ReadAll(br); string(rest) != body {
+				t.Errorf("data after header = %q, want %q", rest, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package klaes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// Encrypted packet blobs start with one of these bytes. OpenPGP packets
+// always start with a byte with the high bit set, and armored submissions
+// with ASCII text, so plaintext blobs can't be mistaken for encrypted ones.
+const (
+	// sealedPacketsPrefix starts blobs whose associated data binds them to
+	// their row: the key fingerprint, or the submission ID.
+	sealedPacketsPrefix = 0x01
+	// unboundPacketsPrefix starts blobs sealed without associated data by
+	// older versions. Only Reseal reads them.
+	unboundPacketsPrefix = 0x00
+)
+
+// resealBatchSize is the number of rows re-encrypted per query by Reseal.
+const resealBatchSize = 100
+
+func newPacketsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptPackets enables encryption of stored packets with AES-GCM. The key
+// must be 16, 24 or 32 bytes long. Packets stored without encryption can't
+// be read anymore, they need to be encrypted with Reseal.
+func (s *Server) EncryptPackets(key []byte) error {
+	aead, err := newPacketsAEAD(key)
+	if err != nil {
+		return err
+	}
+	s.backend.aead = aead
+	return nil
+}
+
+// DecryptPackets adds a key able to read stored packets, besides the one set
+// by EncryptPackets. New packets are never encrypted with it. This allows
+// rotating keys with Reseal.
+func (s *Server) DecryptPackets(key []byte) error {
+	aead, err := newPacketsAEAD(key)
+	if err != nil {
+		return err
+	}
+	s.backend.oldAEADs = append(s.backend.oldAEADs, aead)
+	return nil
+}
+
+// Reseal re-encrypts all stored packets with the key set by EncryptPackets,
+// or stores them in plaintext if none is set. Packets encrypted with another
+// key can only be read if it has been passed to DecryptPackets. Rows are
+// processed in small batches, so the server can keep running meanwhile.
+//
+// Reseal also converts plaintext packets and packets encrypted by older
+// versions, which other operations refuse to read.
+func (s *Server) Reseal() error {
+	return s.backend.resealPackets()
+}
+
+// sealPackets encrypts packets stored in the row identified by ad, usually
+// the key fingerprint. The blob can't be opened with another ad.
+func (be *backend) sealPackets(packets, ad []byte) ([]byte, error) {
+	if be.aead == nil {
+		return packets, nil
+	}
+
+	b := make([]byte, 1+be.aead.NonceSize(), 1+be.aead.NonceSize()+len(packets)+be.aead.Overhead())
+	b[0] = sealedPacketsPrefix
+	nonce := b[1:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return be.aead.Seal(b, nonce, packets, ad), nil
+}
+
+func isSealed(b []byte) bool {
+	return len(b) > 0 && (b[0] == sealedPacketsPrefix || b[0] == unboundPacketsPrefix)
+}
+
+func openSealed(aead cipher.AEAD, b, ad []byte) ([]byte, error) {
+	b = b[1:]
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("klaes: encrypted packets too short")
+	}
+	nonce, ciphertext := b[:aead.NonceSize()], b[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// openPackets decrypts packets sealed by sealPackets with the same ad.
+// Plaintext packets are only accepted if encryption isn't enabled.
+func (be *backend) openPackets(b, ad []byte) ([]byte, error) {
+	if !isSealed(b) {
+		if be.aead != nil {
+			return nil, fmt.Errorf("klaes: stored packets aren't encrypted, they need to be resealed")
+		}
+		return b, nil
+	} else if b[0] == unboundPacketsPrefix {
+		return nil, fmt.Errorf("klaes: stored packets use an old encryption format, they need to be resealed")
+	}
+	return be.unseal(b, ad)
+}
+
+// unseal decrypts a blob with the current key or any old key.
+func (be *backend) unseal(b, ad []byte) ([]byte, error) {
+	aeads := be.oldAEADs
+	if be.aead != nil {
+		aeads = append([]cipher.AEAD{be.aead}, aeads...)
+	}
+	if len(aeads) == 0 {
+		return nil, fmt.Errorf("klaes: stored packets are encrypted, but no key is configured")
+	}
+
+	var err error
+	for _, aead := range aeads {
+		var packets []byte
+		if packets, err = openSealed(aead, b, ad); err == nil {
+			return packets, nil
+		}
+	}
+	return nil, fmt.Errorf("klaes: failed to decrypt packets: %v", err)
+}
+
+// resealPackets encrypts all stored packets with the current key. Rows
+// already encrypted with it are skipped, and rows updated concurrently are
+// left alone since they have been sealed with the current key.
+func (be *backend) resealPackets() error {
+	queries := map[string]string{
+		"Key": `SELECT id, fingerprint, packets FROM Key WHERE id > $1
+			ORDER BY id LIMIT $2`,
+		"KeyVersion": `SELECT KeyVersion.id, Key.fingerprint, KeyVersion.packets
+			FROM KeyVersion, Key WHERE
+				KeyVersion.id > $1 AND
+				Key.id = KeyVersion.key
+			ORDER BY KeyVersion.id LIMIT $2`,
+	}
+
+	type blob struct {
+		id          int64
+		fingerprint []byte
+		packets     []byte
+	}
+
+	for _, table := range []string{"Key", "KeyVersion"} {
+		var lastID int64
+		for {
+			rows, err := be.db.Query(queries[table], lastID, resealBatchSize)
+			if err != nil {
+				return err
+			}
+
+			var blobs []blob
+			for rows.Next() {
+				var b blob
+				if err := rows.Scan(&b.id, &b.fingerprint, &b.packets); err != nil {
+					rows.Close()
+					return err
+				}
+				blobs = append(blobs, b)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if len(blobs) == 0 {
+				break
+			}
+			lastID = blobs[len(blobs)-1].id
+
+			for _, b := range blobs {
+				if err := be.resealBlob(table, b.id, b.fingerprint, b.packets); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return be.resealSubmissions()
+}
+
+// resealed returns the blob b re-encrypted with the current key, or nil if
+// it doesn't need to change.
+func (be *backend) resealed(b, ad []byte) ([]byte, error) {
+	if be.aead == nil && !isSealed(b) {
+		return nil, nil
+	} else if be.aead != nil && isSealed(b) && b[0] == sealedPacketsPrefix {
+		if _, err := openSealed(be.aead, b, ad); err == nil {
+			return nil, nil
+		}
+	}
+
+	packets := b
+	if isSealed(b) {
+		oldAD := ad
+		if b[0] == unboundPacketsPrefix {
+			oldAD = nil
+		}
+		var err error
+		if packets, err = be.unseal(b, oldAD); err != nil {
+			return nil, err
+		}
+	}
+	return be.sealPackets(packets, ad)
+}
+
+func (be *backend) resealBlob(table string, id int64, fingerprint, b []byte) error {
+	sealed, err := be.resealed(b, fingerprint)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %v %v: %v", table, id, err)
+	} else if sealed == nil {
+		return nil
+	}
+
+	digest := sha256.Sum256(sealed)
+	_, err = be.db.Exec(
+		`UPDATE `+table+` SET packets = $1, packets_digest = $2
+		WHERE id = $3 AND packets = $4`,
+		sealed, digest[:], id, b,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update %v %v: %v", table, id, err)
+	}
+	return nil
+}
+
+// resealSubmissions re-encrypts queued submissions. There are few of them,
+// since they are dropped once processed.
+func (be *backend) resealSubmissions() error {
+	rows, err := be.db.Query(`SELECT id, packets FROM Submission WHERE packets IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	type submission struct {
+		id      string
+		keytext []byte
+	}
+	var l []submission
+	for rows.Next() {
+		var sub submission
+		if err := rows.Scan(&sub.id, &sub.keytext); err != nil {
+			rows.Close()
+			return err
+		}
+		l = append(l, sub)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, sub := range l {
+		sealed, err := be.resealed(sub.keytext, []byte(sub.id))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt submission %v: %v", sub.id, err)
+		} else if sealed == nil {
+			continue
+		}
+
+		_, err = be.db.Exec(
+			`UPDATE Submission SET packets = $1 WHERE id = $2 AND packets = $3`,
+			sealed, sub.id, sub.keytext,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update submission %v: %v", sub.id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package klaes
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOpenPacketsOldKey(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	packets := []byte{0x99, 0x00, 0x01, 0x02}
+	ad := []byte("fingerprint")
+
+	var old Server
+	if err := old.EncryptPackets(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := old.backend.sealPackets(packets, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	if err := s.EncryptPackets(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.backend.openPackets(sealed, ad); err == nil {
+		t.Fatal("openPackets() succeeded with the wrong key")
+	}
+
+	if err := s.DecryptPackets(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.backend.openPackets(sealed, ad); err != nil {
+		t.Fatalf("openPackets() = %v", err)
+	} else if !bytes.Equal(b, packets) {
+		t.Errorf("openPackets() = %x, want %x", b, packets)
+	}
+
+	// Plaintext packets are only readable without any key
+	var plain Server
+	if b, err := plain.backend.openPackets(packets, ad); err != nil || !bytes.Equal(b, packets) {
+		t.Errorf("openPackets() = %x, %v, want %x", b, err, packets)
+	}
+	if _, err := plain.backend.openPackets(sealed, ad); err == nil {
+		t.Error("openPackets() succeeded without a key")
+	}
+	if _, err := s.backend.openPackets(packets, ad); err == nil {
+		t.Error("openPackets() accepted plaintext with a key")
+	}
+}
+
+func TestOpenPacketsAssociatedData(t *testing.T) {
+	var s Server
+	if err := s.EncryptPackets(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	packets := []byte{0x99, 0x00, 0x01, 0x02}
+
+	sealed, err := s.backend.sealPackets(packets, []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.backend.openPackets(sealed, []byte("mallory")); err == nil {
+		t.Error("openPackets() succeeded for another row")
+	}
+}
+
+func TestResealed(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	packets := []byte{0x99, 0x00, 0x01, 0x02}
+	ad := []byte("fingerprint")
+
+	var s Server
+	if err := s.EncryptPackets(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blobs sealed by older versions, without associated data
+	unbound, err := s.backend.sealPackets(packets, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbound[0] = unboundPacketsPrefix
+	if _, err := s.backend.openPackets(unbound, ad); err == nil {
+		t.Error("openPackets() accepted an unbound blob")
+	}
+
+	for _, b := range [][]byte{packets, unbound} {
+		sealed, err := s.backend.resealed(b, ad)
+		if err != nil {
+			t.Fatalf("resealed() = %v", err)
+		} else if sealed == nil {
+			t.Fatalf("resealed() = nil, want a new blob")
+		}
+		if got, err := s.backend.openPackets(sealed, ad); err != nil || !bytes.Equal(got, packets) {
+			t.Errorf("openPackets(resealed()) = %x, %v, want %x", got, err, packets)
+		}
+
+		if again, err := s.backend.resealed(sealed, ad); err != nil || again != nil {
+			t.Errorf("resealed() = %x, %v, want nil", again, err)
+		}
+	}
+}
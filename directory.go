@@ -0,0 +1,111 @@
+package klaes
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// adAccountDisabled is the ACCOUNTDISABLE flag of the Active Directory
+// userAccountControl attribute.
+const adAccountDisabled = 0x2
+
+type ldifEntry map[string][]string
+
+// readLDIF parses LDAP entries in the LDIF format, as output by ldapsearch.
+func readLDIF(r io.Reader) ([]ldifEntry, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") && len(lines) > 0 && lines[len(lines)-1] != "" {
+			// Continuation of the previous line
+			lines[len(lines)-1] += line[1:]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var entries []ldifEntry
+	entry := make(ldifEntry)
+	for _, line := range append(lines, "") {
+		if line == "" {
+			if len(entry) > 0 {
+				entries = append(entries, entry)
+				entry = make(ldifEntry)
+			}
+			continue
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("klaes: invalid LDIF line: %q", line)
+		}
+		k, v := strings.ToLower(line[:i]), line[i+1:]
+		if strings.HasPrefix(v, ":") {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("klaes: invalid base64 LDIF value: %v", err)
+			}
+			v = string(b)
+		}
+		entry[k] = append(entry[k], strings.TrimSpace(v))
+	}
+
+	return entries, nil
+}
+
+// directoryEmails returns the email addresses of enabled accounts, taken
+// from the mail and proxyAddresses attributes.
+func directoryEmails(entries []ldifEntry) []string {
+	var emails []string
+	for _, entry := range entries {
+		if l := entry["useraccountcontrol"]; len(l) > 0 {
+			if flags, err := strconv.ParseInt(l[0], 10, 64); err == nil && flags&adAccountDisabled != 0 {
+				continue
+			}
+		}
+
+		for _, mail := range entry["mail"] {
+			emails = append(emails, strings.ToLower(mail))
+		}
+		for _, addr := range entry["proxyaddresses"] {
+			if strings.HasPrefix(strings.ToLower(addr), "smtp:") {
+				emails = append(emails, strings.ToLower(addr[len("smtp:"):]))
+			}
+		}
+	}
+	return emails
+}
+
+// SyncDirectory replaces the list of email addresses allowed by the
+// directory with the accounts listed in r, in the LDIF format. It returns
+// the keys having identities which aren't in the directory anymore.
+//
+// Unless force is set, an empty directory or one less than half the size of
+// the current one is rejected, since it's most likely a failed export.
+func (s *Server) SyncDirectory(r io.Reader, force bool) ([][20]byte, error) {
+	entries, err := readLDIF(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints, err := s.backend.syncDirectory(directoryEmails(entries), force)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([][20]byte, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		copy(l[i][:], fingerprint)
+	}
+	return l, nil
+}
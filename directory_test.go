@@ -0,0 +1,118 @@
+package klaes
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadLDIF(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []ldifEntry
+		err  bool
+	}{
+		{
+			name: "empty",
+			in:   "",
+		},
+		{
+			name: "entries",
+			in: "# extended LDIF\n" +
+				"\n" +
+				"dn: CN=Alice,DC=example,DC=org\n" +
+				"mail: alice@example.org\n" +
+				"proxyAddresses: SMTP:alice@example.org\n" +
+				"proxyAddresses: smtp:a@example.org\n" +
+				"\n" +
+				"\n" +
+				"dn: CN=Bob,DC=example,DC=org\n" +
+				"mail: bob@example.org\n",
+			want: []ldifEntry{
+				{
+					"dn":             {"CN=Alice,DC=example,DC=org"},
+					"mail":           {"alice@example.org"},
+					"proxyaddresses": {"SMTP:alice@example.org", "smtp:a@example.org"},
+				},
+				{
+					"dn":   {"CN=Bob,DC=example,DC=org"},
+					"mail": {"bob@example.org"},
+				},
+			},
+		},
+		{
+			name: "CRLF and folded lines",
+			in: "dn: CN=Alice,DC=exam\r\n" +
+				" ple,DC=org\r\n" +
+				"mail: alice@\r\n" +
+				" example.org\r\n",
+			want: []ldifEntry{
+				{
+					"dn":   {"CN=Alice,DC=example,DC=org"},
+					"mail": {"alice@example.org"},
+				},
+			},
+		},
+		{
+			name: "base64",
+			in: "dn:: Q049QWxpY2U=\n" +
+				"cn:: w4lsaXNl\n",
+			want: []ldifEntry{
+				{
+					"dn": {"CN=Alice"},
+					"cn": {"Élise"},
+				},
+			},
+		},
+		{
+			name: "invalid base64",
+			in:   "dn:: ???\n",
+			err:  true,
+		},
+		{
+			name: "missing colon",
+			in:   "dn: CN=Alice\ngarbage\n",
+			err:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readLDIF(strings.NewReader(tc.in))
+			if tc.err {
+				if err == nil {
+					t.Fatal("readLDIF() succeeded, want an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("readLDIF() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readLDIF() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDirectoryEmails(t *testing.T) {
+	entries := []ldifEntry{
+		{
+			"mail":           {"Alice@Example.org"},
+			"proxyaddresses": {"SMTP:alice@example.org", "smtp:a@example.org", "X500:/o=Example"},
+		},
+		{
+			"mail":               {"disabled@example.org"},
+			"useraccountcontrol": {"514"},
+		},
+		{
+			"mail":               {"bob@example.org"},
+			"useraccountcontrol": {"512"},
+		},
+	}
+
+	want := []string{"alice@example.org", "alice@example.org", "a@example.org", "bob@example.org"}
+	if got := directoryEmails(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("directoryEmails() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package klaes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+const defaultExpiringDays = 30
+
+type jsonKey struct {
+	Fingerprint    string    `json:"fingerprint"`
+	CreationTime   time.Time `json:"creation_time"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	Identities     []string  `json:"identities"`
+}
+
+func newJSONKey(key *hkp.IndexKey) jsonKey {
+	k := jsonKey{
+		Fingerprint:    fmt.Sprintf("%X", key.Fingerprint[:]),
+		CreationTime:   key.CreationTime,
+		ExpirationTime: key.ExpirationTime,
+	}
+	for _, ident := range key.Identities {
+		k.Identities = append(k.Identities, ident.Name)
+	}
+	return k
+}
+
+// serveExpiring lists keys expiring within the next days (30 by default),
+// optionally restricted to identities in a domain.
+func (s *Server) serveExpiring(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+
+	days := defaultExpiringDays
+	if v := q.Get("days"); v != "" {
+		var err error
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 0 {
+			http.Error(w, "Invalid days parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	until := time.Now().AddDate(0, 0, days)
+	keys, err := s.backend.expiringKeys(r.Context(), until, q.Get("domain"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	l := make([]jsonKey, 0, len(keys))
+	for i := range keys {
+		l = append(l, newJSONKey(&keys[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,96 @@
+package klaes
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+const feedLimit = 50
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated time.Time `xml:"updated"`
+	Link    atomLink  `xml:"link"`
+	Summary string    `xml:"summary,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// serveFeed publishes an Atom feed of recently added, updated and revoked
+// keys, optionally restricted to keys with identities in a domain.
+func (s *Server) serveFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	events, err := s.backend.keyEvents(domain, feedLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	base := s.baseURL(r)
+	feed := atomFeed{
+		ID:    base + r.URL.RequestURI(),
+		Title: "Key updates",
+		Link:  []atomLink{{Rel: "self", Href: base + r.URL.RequestURI()}},
+	}
+	if domain != "" {
+		feed.Title = "Key updates for " + domain
+	}
+	if len(events) > 0 {
+		feed.Updated = events[0].time
+	} else {
+		feed.Updated = time.Now()
+	}
+
+	for _, ev := range events {
+		title := fmt.Sprintf("Key %X updated", ev.fingerprint)
+		if ev.added {
+			title = fmt.Sprintf("New key %X", ev.fingerprint)
+		} else if ev.revoked {
+			title = fmt.Sprintf("Key %X revoked", ev.fingerprint)
+		}
+
+		q := url.Values{}
+		q.Set("op", "get")
+		q.Set("search", fmt.Sprintf("0x%X", ev.fingerprint))
+		link := base + hkp.Base + "/lookup?" + q.Encode()
+
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("%v#version-%v", link, ev.version),
+			Title:   title,
+			Updated: ev.time,
+			Link:    atomLink{Href: link},
+			Summary: ev.identities,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(&feed); err != nil {
+		panic(err)
+	}
+}
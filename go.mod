@@ -1,11 +1,24 @@
 module github.com/emersion/klaes
 
-go 1.12
+go 1.26.0
 
 require (
 	github.com/emersion/go-openpgp-hkp v0.0.0-20180913132822-059dbf2e8bfa
 	github.com/emersion/go-openpgp-wkd v0.0.0-20191011220651-01af8781ec9b
+	github.com/go-ldap/ldap/v3 v3.4.14
 	github.com/lib/pq v1.3.0
+	github.com/quic-go/quic-go v0.63.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.54.0
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.1.1 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.8 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
 	github.com/tv42/zbase32 v0.0.0-20190604154422-aacc64a8f915 // indirect
-	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
 )
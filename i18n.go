@@ -0,0 +1,121 @@
+package klaes
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// catalogs contains translations of the web UI and notification messages,
+// keyed by locale and then by the English message.
+var catalogs = map[string]map[string]string{
+	"de": {
+		"Search":                          "Suchen",
+		"No keys found.":                  "Keine Schlüssel gefunden.",
+		"Created":                         "Erstellt",
+		"created":                         "erstellt",
+		"expires":                         "läuft ab",
+		"revoked":                         "widerrufen",
+		"bits":                            "Bit",
+		"Download":                        "Herunterladen",
+		"User IDs":                        "Benutzerkennungen",
+		"Subkeys":                         "Unterschlüssel",
+		"Ownership verified by signature": "Besitz durch Signatur bestätigt",
+
+		"Another key was uploaded for %v": "Ein weiterer Schlüssel wurde für %v hochgeladen",
+		"The key %X was uploaded to the keyserver with the email address %v, which is already used by your key %X.": "Der Schlüssel %X wurde mit der E-Mail-Adresse %v auf den Keyserver hochgeladen, die bereits von Ihrem Schlüssel %X verwendet wird.",
+		"The new key is held and won't be served until an administrator releases it.":                               "Der neue Schlüssel wird zurückgehalten, bis ein Administrator ihn freigibt.",
+		"The new key is served along with yours.":                                                                   "Der neue Schlüssel wird zusammen mit Ihrem ausgeliefert.",
+		"If you didn't upload it, please contact the keyserver administrators.":                                     "Falls Sie ihn nicht hochgeladen haben, wenden Sie sich bitte an die Administratoren des Keyservers.",
+	},
+	"fr": {
+		"Search":                          "Rechercher",
+		"No keys found.":                  "Aucune clé trouvée.",
+		"Created":                         "Créée le",
+		"created":                         "créée le",
+		"expires":                         "expire le",
+		"revoked":                         "révoquée",
+		"bits":                            "bits",
+		"Download":                        "Télécharger",
+		"User IDs":                        "Identités",
+		"Subkeys":                         "Sous-clés",
+		"Ownership verified by signature": "Propriété vérifiée par signature",
+
+		"Another key was uploaded for %v": "Une autre clé a été envoyée pour %v",
+		"The key %X was uploaded to the keyserver with the email address %v, which is already used by your key %X.": "La clé %X a été envoyée au serveur de clés avec l'adresse email %v, déjà utilisée par votre clé %X.",
+		"The new key is held and won't be served until an administrator releases it.":                               "La nouvelle clé est retenue et ne sera pas distribuée avant qu'un administrateur la libère.",
+		"The new key is served along with yours.":                                                                   "La nouvelle clé est distribuée avec la vôtre.",
+		"If you didn't upload it, please contact the keyserver administrators.":                                     "Si vous ne l'avez pas envoyée, veuillez contacter les administrateurs du serveur de clés.",
+	},
+}
+
+// locale translates web UI and notification messages.
+type locale struct {
+	Tag      string
+	messages map[string]string
+}
+
+// T returns the translation of msg, or msg itself if there is none.
+func (l *locale) T(msg string) string {
+	if s, ok := l.messages[msg]; ok {
+		return s
+	}
+	return msg
+}
+
+// hasLocale checks whether a locale can be served. English is built in.
+func hasLocale(tag string) bool {
+	_, ok := catalogs[tag]
+	return ok || tag == "en"
+}
+
+// negotiateLocale picks a locale from the request's Accept-Language header,
+// falling back to def and then to English.
+func negotiateLocale(r *http.Request, def string) *locale {
+	type accepted struct {
+		tag string
+		q   float64
+	}
+	var l []accepted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			l = append(l, accepted{tag, q})
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].q > l[j].q
+	})
+
+	tag := "en"
+	if hasLocale(def) {
+		tag = def
+	}
+	for _, a := range l {
+		// Try "de-CH" and then "de"
+		if hasLocale(a.tag) {
+			tag = a.tag
+			break
+		}
+		if i := strings.IndexByte(a.tag, '-'); i > 0 && hasLocale(a.tag[:i]) {
+			tag = a.tag[:i]
+			break
+		}
+	}
+
+	return &locale{Tag: tag, messages: catalogs[tag]}
+}
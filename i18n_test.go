@@ -0,0 +1,75 @@
+package klaes
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		def            string
+		want           string
+	}{
+		{"", "en", "en"},
+		{"", "fr", "fr"},
+		{"", "es", "en"},
+		{"de", "en", "de"},
+		{"FR", "en", "fr"},
+		{"de-CH", "en", "de"},
+		{"en-US,en;q=0.9", "fr", "en"},
+		{"es, fr;q=0.5", "en", "fr"},
+		{"fr;q=0.5, de;q=0.8", "en", "de"},
+		{"fr;q=0.5, de", "en", "de"},
+		{"de;q=0, fr;q=0.1", "en", "fr"},
+		{"de;q=0", "fr", "fr"},
+		{"fr, de", "en", "fr"},
+		{"fr;q=invalid, de;q=0.5", "en", "fr"},
+		{"*", "de", "de"},
+		{"es, ja", "en", "en"},
+		{" , ;q=1, de", "en", "de"},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.acceptLanguage != "" {
+			r.Header.Set("Accept-Language", tc.acceptLanguage)
+		}
+		l := negotiateLocale(r, tc.def)
+		if l.Tag != tc.want {
+			t.Errorf("negotiateLocale(%q, %q) = %q, want %q", tc.acceptLanguage, tc.def, l.Tag, tc.want)
+		}
+	}
+}
+
+func TestLocaleT(t *testing.T) {
+	l := &locale{Tag: "de", messages: catalogs["de"]}
+	if s := l.T("Search"); s != "Suchen" {
+		t.Errorf("T(%q) = %q, want %q", "Search", s, "Suchen")
+	}
+	if s := l.T("Untranslated"); s != "Untranslated" {
+		t.Errorf("T(%q) = %q, want %q", "Untranslated", s, "Untranslated")
+	}
+}
+
+func TestClaimNotice(t *testing.T) {
+	var claimed, by [20]byte
+	claimed[0], by[0] = 0xAA, 0xBB
+
+	s := Server{DefaultLocale: "fr"}
+	subject, body := s.ClaimNotice("alice@example.org", claimed, by, true)
+	if want := "Une autre clé a été envoyée pour alice@example.org"; subject != want {
+		t.Errorf("subject = %q, want %q", subject, want)
+	}
+	for _, want := range []string{"La clé BB00", "votre clé AA00", "retenue"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body = %q, want it to contain %q", body, want)
+		}
+	}
+
+	s.DefaultLocale = "es"
+	if subject, _ := s.ClaimNotice("alice@example.org", claimed, by, false); subject != "Another key was uploaded for alice@example.org" {
+		t.Errorf("subject = %q, want the English one", subject)
+	}
+}
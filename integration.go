@@ -0,0 +1,163 @@
+package klaes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Directory is implemented by Server. It lets a mail server look up and
+// publish the keys of the mailboxes it hosts, bypassing the public lookup
+// policies.
+type Directory interface {
+	// Lookup returns all keys with an identity for the email address.
+	Lookup(email string) (openpgp.EntityList, error)
+	// Publish imports a key on behalf of its owner. The key is served even
+	// if it claims an email address already used by another key.
+	Publish(e *openpgp.Entity) error
+}
+
+var _ Directory = (*Server)(nil)
+
+func (s *Server) Lookup(email string) (openpgp.EntityList, error) {
+	return s.backend.discover(context.Background(), "Identity.email = $1", strings.ToLower(email))
+}
+
+func (s *Server) Publish(e *openpgp.Entity) error {
+	_, err := s.publish(context.Background(), e, nil)
+	return err
+}
+
+// publish imports a key on behalf of its owner and releases it. If isHosted
+// isn't nil, the key is only released if all email addresses of the stored
+// key, which may have been merged with a previous submission, are hosted.
+func (s *Server) publish(ctx context.Context, e *openpgp.Entity, isHosted func(email string) bool) (released bool, err error) {
+	if err := s.importEntity(ctx, e, importOptions{trusted: true}); err != nil {
+		return false, err
+	}
+
+	fingerprint := e.PrimaryKey.Fingerprint[:]
+	if isHosted != nil {
+		emails, err := s.backend.keyEmails(fingerprint)
+		if err != nil {
+			return false, err
+		}
+		for _, email := range emails {
+			if !isHosted(email) {
+				return false, nil
+			}
+		}
+	}
+
+	if err := s.backend.releaseKey(fingerprint); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IntegrationHandler exposes Directory over HTTP for mail servers, for
+// instance on a unix socket. Only email addresses in the listed domains can
+// be looked up and published.
+//
+// GET /keys?email=<address> returns the binary keys for an address,
+// PUT /keys publishes the binary or armored keys in the request body. All
+// identities of a published key must be in the listed domains. If the stored
+// key also has identities from other submissions outside of them, it isn't
+// released and 202 Accepted is returned.
+func (s *Server) IntegrationHandler(domains []string) http.Handler {
+	hosted := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		hosted[strings.ToLower(domain)] = true
+	}
+
+	isHosted := func(email string) bool {
+		i := strings.LastIndexByte(email, '@')
+		return i >= 0 && hosted[strings.ToLower(email[i+1:])]
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/keys" {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			email := r.URL.Query().Get("email")
+			if !isHosted(email) {
+				http.Error(w, "Domain not hosted", http.StatusForbidden)
+				return
+			}
+
+			el, err := s.Lookup(email)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if len(el) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			for _, e := range el {
+				if err := serializeEntity(w, e); err != nil {
+					panic(err)
+				}
+			}
+		case http.MethodPut:
+			el, err := readKeys(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			for _, e := range el {
+				for _, ident := range e.Identities {
+					if !isHosted(ident.UserId.Email) {
+						http.Error(w, fmt.Sprintf("Identity %q of key %X is not in a hosted domain", ident.Name, e.PrimaryKey.Fingerprint[:]), http.StatusForbidden)
+						return
+					}
+				}
+			}
+
+			status := http.StatusNoContent
+			for _, e := range el {
+				if released, err := s.publish(r.Context(), e, isHosted); err == ErrReadOnly {
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				} else if !released {
+					status = http.StatusAccepted
+				}
+			}
+			w.WriteHeader(status)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// readKeys reads a binary or armored keyring.
+func readKeys(r io.Reader) (openpgp.EntityList, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, err := armor.Decode(bytes.NewReader(b)); err == nil {
+		if block.Type != openpgp.PublicKeyType {
+			return nil, fmt.Errorf("klaes: invalid armor block type: %v", block.Type)
+		}
+		return openpgp.ReadKeyRing(block.Body)
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(b))
+}
@@ -0,0 +1,186 @@
+package klaes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const maxKeyringEmails = 1000
+
+// keyringPolicy only includes keys which can currently be used.
+var keyringPolicy = Policy{WithholdExpired: true, WithholdRevoked: true}
+
+func (be *backend) setGroup(name string, emails []string) error {
+	tx, err := be.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %v", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM KeyringGroup WHERE name = $1`, name); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete group: %v", err)
+	}
+
+	for _, email := range emails {
+		_, err := tx.Exec(
+			`INSERT INTO KeyringGroup(name, email) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`,
+			name, strings.ToLower(email),
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert group member: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (be *backend) group(name string) ([]string, error) {
+	rows, err := be.db.Query(
+		`SELECT email FROM KeyringGroup WHERE name = $1 ORDER BY email`,
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// SetGroup replaces the email addresses of a named group, which can then be
+// exported as a keyring with Group and Keyring. An empty list deletes the
+// group.
+func (s *Server) SetGroup(name string, emails []string) error {
+	return s.backend.setGroup(name, emails)
+}
+
+// Group returns the email addresses of a named group.
+func (s *Server) Group(name string) ([]string, error) {
+	return s.backend.group(name)
+}
+
+// Keyring returns the current keys of a list of email addresses, excluding
+// expired and revoked keys and identities. Addresses without any current key
+// are returned in missing.
+func (s *Server) Keyring(emails []string) (el openpgp.EntityList, missing []string, err error) {
+	seen := make(map[[20]byte]bool)
+	for _, email := range emails {
+		l, err := s.backend.discover(
+			context.Background(),
+			"Identity.email = $1 AND NOT Identity.revoked"+keyringPolicy.where(),
+			strings.ToLower(email),
+		)
+		if err != nil {
+			return nil, nil, err
+		} else if len(l) == 0 {
+			missing = append(missing, email)
+			continue
+		}
+
+		for _, e := range l {
+			if !seen[e.PrimaryKey.Fingerprint] {
+				seen[e.PrimaryKey.Fingerprint] = true
+				el = append(el, currentIdentities(e))
+			}
+		}
+	}
+	return el, missing, nil
+}
+
+// currentIdentities returns a copy of a key without its revoked and expired
+// identities.
+func currentIdentities(e *openpgp.Entity) *openpgp.Entity {
+	now := time.Now()
+	c := *e
+	c.Identities = make(map[string]*openpgp.Identity, len(e.Identities))
+	for name, ident := range e.Identities {
+		if identityRevoked(e, ident) {
+			continue
+		}
+		if t := keyExpirationTime(e.PrimaryKey, ident.SelfSignature); !t.IsZero() && t.Before(now) {
+			continue
+		}
+		c.Identities[name] = ident
+	}
+	return &c
+}
+
+// WriteKeyring writes an armored keyring, keeping revocation signatures.
+func WriteKeyring(w io.Writer, el openpgp.EntityList) error {
+	aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	for _, e := range el {
+		if err := serializeEntity(aw, e); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// serveKeyring returns a single armored keyring with the current keys of
+// the email addresses passed in the "email" query parameters, or of the
+// named group passed in the "group" query parameter. If an address has no
+// current key, nothing is returned.
+func (s *Server) serveKeyring(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	emails := q["email"]
+	if name := q.Get("group"); name != "" {
+		members, err := s.Group(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if len(members) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		emails = append(emails, members...)
+	}
+	if len(emails) == 0 {
+		http.Error(w, "Missing email or group parameter", http.StatusBadRequest)
+		return
+	} else if len(emails) > maxKeyringEmails {
+		http.Error(w, fmt.Sprintf("Too many email addresses (maximum %v)", maxKeyringEmails), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	el, missing, err := s.Keyring(emails)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(missing) > 0 {
+		http.Error(w, "No current key for: "+strings.Join(missing, ", "), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	if err := WriteKeyring(w, el); err != nil {
+		panic(err)
+	}
+}
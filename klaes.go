@@ -1,33 +1,220 @@
 package klaes
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-openpgp-hkp"
+	"github.com/emersion/go-openpgp-wkd"
 	"golang.org/x/crypto/openpgp"
 )
 
+// ErrReadOnly is returned when a key is submitted while the server is
+// read-only.
+var ErrReadOnly = errors.New("klaes: server is read-only")
+
+// KeyVersion is a stored revision of a key.
+type KeyVersion struct {
+	ID           int
+	CreationTime time.Time
+}
+
 type Server struct {
-	backend backend
-	hkp     hkp.Handler
+	// If HoldClaimedKeys is set, keys adding an email address already used
+	// by another key with verified ownership (see VerifyOwnership) aren't
+	// served until released with Release.
+	HoldClaimedKeys bool
+	// EmailClaimed, if set, is called after a key adding an email address
+	// already used by another key with verified ownership has been imported,
+	// e.g. to notify the owner of the claimed key.
+	EmailClaimed func(email string, claimed, by [20]byte)
+	// If DirectoryOnly is set, keys with identities missing from the
+	// directory (see SyncDirectory) are rejected.
+	DirectoryOnly bool
+	// HKPPolicy and WKDPolicy control which keys are served over HKP and WKD.
+	HKPPolicy Policy
+	WKDPolicy Policy
+	// BaseURL is the public URL of the server, e.g.
+	// "https://example.org/keys". If it has a path, all endpoints are served
+	// under this path. If empty, the URL is derived from requests.
+	BaseURL string
+	// CachePolicy sets the cache headers of responses.
+	CachePolicy CachePolicy
+	// WKDDomains restricts Web Key Directory lookups to the listed domains.
+	// If nil, all domains are served with both methods.
+	WKDDomains map[string]WKDDomain
+	// DefaultLocale is the language of the web UI when the client doesn't
+	// ask for a supported one, and of notifications, e.g. "de". Defaults to
+	// English.
+	DefaultLocale string
+
+	backend  backend
+	mux      http.ServeMux
+	readOnly int32
+	log      transparencyLog
 }
 
 func NewServer(db *sql.DB) *Server {
 	s := &Server{}
 	s.backend.db = db
-	s.hkp.Lookuper = &s.backend
+	s.backend.cache = newKeyCache(defaultCacheSize)
+	s.mux.HandleFunc(hkp.Base+"/", s.serveHKP)
+	s.mux.HandleFunc(hkp.Base+"/add", s.serveAdd)
+	s.mux.HandleFunc(wkd.Base+"/", s.serveWKD)
+	s.mux.HandleFunc("/expiring", s.serveExpiring)
+	s.mux.HandleFunc("/autocrypt", s.serveAutocrypt)
+	s.mux.HandleFunc("/feed", s.serveFeed)
+	s.mux.HandleFunc("/batch", s.serveBatch)
+	s.mux.HandleFunc("/keyring", s.serveKeyring)
+	s.mux.HandleFunc("/log/", s.serveLog)
+	s.mux.HandleFunc("/revoke", s.serveRevoke)
+	s.mux.HandleFunc("/manage", s.serveManage)
+	s.mux.HandleFunc("/submission/", s.serveSubmission)
+	s.mux.HandleFunc("/search", s.serveSearch)
+	s.mux.HandleFunc("/key/", s.serveKey)
+	s.mux.HandleFunc("/opensearch.xml", s.serveOpenSearch)
 	return s
 }
 
+// basePath returns the path prefix of BaseURL, without a trailing slash.
+func (s *Server) basePath() string {
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// baseURL returns the URL of the server root as seen by the client, without
+// a trailing slash.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.hkp.ServeHTTP(w, r)
+	var h http.Handler = http.HandlerFunc(s.serveHTTP)
+	if p := s.basePath(); p != "" {
+		h = http.StripPrefix(p, h)
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Degraded() && !servesDegraded(r) {
+		serveUnavailable(w)
+		return
+	}
+	s.mux.ServeHTTP(s.CachePolicy.wrap(w, r), r)
+}
+
+// SetReadOnly toggles the read-only mode, in which key submissions and
+// revocations are rejected with ErrReadOnly. Lookups are unaffected.
+func (s *Server) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&s.readOnly, v)
+}
+
+func (s *Server) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+// KeyCount returns the number of stored keys.
+func (s *Server) KeyCount() (int, error) {
+	return s.backend.countKeys()
 }
 
 func (s *Server) Import(e *openpgp.Entity) error {
-	return s.backend.importEntity(e)
+	return s.importEntity(context.Background(), e, importOptions{holdClaimed: s.HoldClaimedKeys, trusted: true})
+}
+
+func (s *Server) importEntity(ctx context.Context, e *openpgp.Entity, opts importOptions) error {
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	if s.DirectoryOnly {
+		var emails []string
+		for _, ident := range e.Identities {
+			// User IDs with only a name aren't tied to an account
+			if ident.UserId.Email != "" {
+				emails = append(emails, strings.ToLower(ident.UserId.Email))
+			}
+		}
+
+		missing, err := s.backend.directoryMissing(emails)
+		if err != nil {
+			return err
+		} else if len(missing) > 0 {
+			return fmt.Errorf("klaes: email addresses not in directory: %v", strings.Join(missing, ", "))
+		}
+	}
+
+	claims, err := s.backend.importEntity(ctx, e, opts)
+	if err != nil {
+		return err
+	}
+
+	if s.EmailClaimed != nil {
+		for _, claim := range claims {
+			var claimed [20]byte
+			copy(claimed[:], claim.fingerprint)
+			s.EmailClaimed(claim.email, claimed, e.PrimaryKey.Fingerprint)
+		}
+	}
+
+	return nil
+}
+
+// Revalidate recomputes the expiration and revocation status of all keys
+// from their stored packets. Keys which can't be read are passed to report.
+// It returns the number of keys updated.
+func (s *Server) Revalidate(report func(msg string)) (int, error) {
+	return s.backend.revalidateKeys(report)
+}
+
+// Release serves a key held because of an email address claim.
+func (s *Server) Release(fingerprint [20]byte) error {
+	return s.backend.releaseKey(fingerprint[:])
 }
 
 func (s *Server) Export(ch chan<- openpgp.EntityList) error {
 	return s.backend.exportEntities(ch)
 }
+
+// KeyVersions lists the stored revisions of a key, oldest first.
+func (s *Server) KeyVersions(fingerprint [20]byte) ([]KeyVersion, error) {
+	return s.backend.keyVersions(fingerprint[:])
+}
+
+// DiffKeyVersions describes the packets added and removed between two
+// revisions of a key, one change per line.
+func (s *Server) DiffKeyVersions(from, to int) ([]string, error) {
+	changes, err := s.backend.diffKeyVersions(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]string, len(changes))
+	for i := range changes {
+		l[i] = changes[i].String()
+	}
+	return l, nil
+}
@@ -0,0 +1,85 @@
+package klaes
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ErrKeyLocked is returned when an update to a locked key is submitted
+// without its management token.
+var ErrKeyLocked = errors.New("klaes: key is locked, a valid management token is required")
+
+// checkLock rejects updates to a locked key unless token is its management
+// token. The key row is locked until the end of the transaction.
+func checkLock(ctx context.Context, tx *sql.Tx, fingerprint []byte, token string) error {
+	var digest []byte
+	err := tx.QueryRowContext(
+		ctx,
+		`SELECT lock_digest FROM Key WHERE fingerprint = $1 FOR UPDATE`,
+		fingerprint,
+	).Scan(&digest)
+	if err == sql.ErrNoRows || (err == nil && digest == nil) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to fetch key lock: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	if token == "" || subtle.ConstantTimeCompare(sum[:], digest) != 1 {
+		return ErrKeyLocked
+	}
+	return nil
+}
+
+func (be *backend) setLock(fingerprint []byte, digest []byte) error {
+	res, err := be.db.Exec(
+		`UPDATE Key SET lock_digest = $1 WHERE fingerprint = $2`,
+		digest, fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("klaes: key not found")
+	}
+	return nil
+}
+
+// Lock locks a key, so that updates from public submission channels are only
+// accepted along with the returned management token. Locking an already
+// locked key replaces its token.
+func (s *Server) Lock(fingerprint [20]byte) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	digest := sha256.Sum256([]byte(token))
+	if err := s.backend.setLock(fingerprint[:], digest[:]); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Unlock removes the lock of a key.
+func (s *Server) Unlock(fingerprint [20]byte) error {
+	return s.backend.setLock(fingerprint[:], nil)
+}
+
+// ImportWithToken imports a key submitted over a public channel. If the key
+// is locked, token must be its management token, otherwise ErrKeyLocked is
+// returned.
+func (s *Server) ImportWithToken(e *openpgp.Entity, token string) error {
+	return s.importEntity(context.Background(), e, importOptions{holdClaimed: s.HoldClaimedKeys, token: token})
+}
@@ -0,0 +1,182 @@
+package klaes
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+const maxMailPartDepth = 8
+
+func decodeTransferEncoding(h textproto.MIMEHeader, r io.Reader) io.Reader {
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// armoredKeyBlocks extracts the armored public key blocks inlined in text.
+func armoredKeyBlocks(text string) []string {
+	const begin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	const end = "-----END PGP PUBLIC KEY BLOCK-----"
+
+	var blocks []string
+	for {
+		i := strings.Index(text, begin)
+		if i < 0 {
+			break
+		}
+		j := strings.Index(text[i:], end)
+		if j < 0 {
+			break
+		}
+		blocks = append(blocks, text[i:i+j+len(end)])
+		text = text[i+j+len(end):]
+	}
+	return blocks
+}
+
+// mailPartKeys collects the keys attached as application/pgp-keys parts
+// (which includes unencrypted Web Key Service submissions) or inlined in
+// text parts.
+func mailPartKeys(h textproto.MIMEHeader, r io.Reader, depth int) (openpgp.EntityList, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if depth >= maxMailPartDepth {
+			return nil, fmt.Errorf("klaes: too many nested message parts")
+		}
+
+		var el openpgp.EntityList
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			l, err := mailPartKeys(p.Header, p, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			el = append(el, l...)
+		}
+		return el, nil
+	case mediaType == "application/pgp-keys":
+		return readKeys(decodeTransferEncoding(h, r))
+	case strings.HasPrefix(mediaType, "text/"):
+		b, err := ioutil.ReadAll(decodeTransferEncoding(h, r))
+		if err != nil {
+			return nil, err
+		}
+
+		var el openpgp.EntityList
+		for _, block := range armoredKeyBlocks(string(b)) {
+			l, err := openpgp.ReadArmoredKeyRing(strings.NewReader(block))
+			if err != nil {
+				return nil, err
+			}
+			el = append(el, l...)
+		}
+		return el, nil
+	default:
+		return nil, nil
+	}
+}
+
+// mailKeys returns the keys found in a message, along with the management
+// token for locked keys passed in the Klaes-Management-Token header.
+func mailKeys(r io.Reader) (openpgp.EntityList, string, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, "", err
+	}
+	el, err := mailPartKeys(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	return el, strings.TrimSpace(msg.Header.Get("Klaes-Management-Token")), err
+}
+
+func (s *Server) ingestMail(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	el, token, err := mailKeys(f)
+	if err != nil {
+		return err
+	} else if len(el) == 0 {
+		return fmt.Errorf("klaes: no public key found in message")
+	}
+
+	for _, e := range el {
+		if err := s.ImportWithToken(e, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IngestMaildir imports the keys attached to or inlined in the new messages
+// of a Maildir. Messages are then marked as seen and moved to the cur
+// directory, even if they couldn't be imported: errors are passed to report.
+// The number of messages processed is returned.
+//
+// Ingestion stops and the message is left in the new directory if the
+// server is read-only or the database can't be reached, so that it is
+// retried on the next call.
+//
+// Updates to locked keys must carry the management token in the
+// Klaes-Management-Token header.
+func (s *Server) IngestMaildir(dir string, report func(name string, err error)) (int, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, fi := range entries {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, "new", fi.Name())
+		if err := s.ingestMail(path); err == ErrReadOnly {
+			return n, err
+		} else if err != nil {
+			if pingErr := s.backend.db.Ping(); pingErr != nil {
+				return n, fmt.Errorf("failed to ingest message %v: %v", fi.Name(), err)
+			}
+			report(fi.Name(), err)
+		}
+
+		cur := filepath.Join(dir, "cur", fi.Name()+":2,S")
+		if err := os.Rename(path, cur); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,230 @@
+package klaes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Merkle tree hashing as defined in RFC 6962 section 2.1.
+
+func merkleLeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of two smaller than n, for n > 1.
+func merkleSplit(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot computes the root hash of a tree from its leaf hashes.
+func merkleRoot(leaves [][]byte) []byte {
+	switch n := uint64(len(leaves)); n {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	default:
+		k := merkleSplit(n)
+		return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+	}
+}
+
+// merkleTree keeps the hashes of the complete subtrees of an append-only
+// tree, so that roots and proofs for any tree size can be computed without
+// rehashing all leaves.
+type merkleTree struct {
+	// levels[h][i] is the hash of the complete subtree of 2^h leaves
+	// starting at leaf i*2^h
+	levels [][][]byte
+}
+
+func (t *merkleTree) size() uint64 {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return uint64(len(t.levels[0]))
+}
+
+func (t *merkleTree) append(leafHash []byte) {
+	h := leafHash
+	for level := 0; ; level++ {
+		if level == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		t.levels[level] = append(t.levels[level], h)
+
+		n := len(t.levels[level])
+		if n%2 != 0 {
+			return
+		}
+		h = merkleNodeHash(t.levels[level][n-2], h)
+	}
+}
+
+// hash returns the root hash of the n leaves starting at leaf start, which
+// must be a multiple of the largest power of two smaller than n.
+func (t *merkleTree) hash(start, n uint64) []byte {
+	if n == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	if n&(n-1) == 0 {
+		level := 0
+		for uint64(1)<<uint(level) < n {
+			level++
+		}
+		return t.levels[level][start/n]
+	}
+	k := merkleSplit(n)
+	return merkleNodeHash(t.hash(start, k), t.hash(start+k, n-k))
+}
+
+// root returns the root hash of the tree made of the first n leaves.
+func (t *merkleTree) root(n uint64) []byte {
+	return t.hash(0, n)
+}
+
+// path returns the audit path of leaf m in the tree made of the first n
+// leaves.
+func (t *merkleTree) path(m, n uint64) [][]byte {
+	return t.subpath(m, 0, n)
+}
+
+func (t *merkleTree) subpath(m, start, n uint64) [][]byte {
+	if n <= 1 {
+		return nil
+	}
+	k := merkleSplit(n)
+	if m < k {
+		return append(t.subpath(m, start, k), t.hash(start+k, n-k))
+	}
+	return append(t.subpath(m-k, start+k, n-k), t.hash(start, k))
+}
+
+// consistency returns the consistency proof between the trees made of the
+// first m and n leaves.
+func (t *merkleTree) consistency(m, n uint64) [][]byte {
+	if m == 0 || m == n {
+		return nil
+	}
+	return t.subproof(m, 0, n, true)
+}
+
+func (t *merkleTree) subproof(m, start, n uint64, complete bool) [][]byte {
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{t.hash(start, n)}
+	}
+	k := merkleSplit(n)
+	if m <= k {
+		return append(t.subproof(m, start, k, complete), t.hash(start+k, n-k))
+	}
+	return append(t.subproof(m-k, start+k, n-k, false), t.hash(start, k))
+}
+
+// VerifyInclusion checks that a leaf is part of a tree, given its audit path
+// as returned by the log. The algorithm is described in RFC 9162 section
+// 2.1.3.2.
+func VerifyInclusion(leafIndex, treeSize uint64, leafHash []byte, path [][]byte, root []byte) error {
+	if leafIndex >= treeSize {
+		return fmt.Errorf("klaes: leaf index %v out of range for tree size %v", leafIndex, treeSize)
+	}
+
+	fn, sn := leafIndex, treeSize-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return fmt.Errorf("klaes: inclusion proof too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(r, root) {
+		return fmt.Errorf("klaes: invalid inclusion proof")
+	}
+	return nil
+}
+
+// VerifyConsistency checks that a tree is an append-only extension of an
+// older one, given the consistency proof returned by the log. The algorithm
+// is described in RFC 9162 section 2.1.4.2.
+func VerifyConsistency(firstSize, secondSize uint64, firstRoot, secondRoot []byte, path [][]byte) error {
+	switch {
+	case firstSize > secondSize:
+		return fmt.Errorf("klaes: tree shrank from %v to %v leaves", firstSize, secondSize)
+	case firstSize == secondSize:
+		if len(path) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return fmt.Errorf("klaes: different roots for the same tree size")
+		}
+		return nil
+	case firstSize == 0:
+		return nil
+	}
+
+	// If the first tree is complete, its root is the first node of the path
+	if firstSize&(firstSize-1) == 0 {
+		path = append([][]byte{firstRoot}, path...)
+	}
+	if len(path) == 0 {
+		return fmt.Errorf("klaes: empty consistency proof")
+	}
+
+	fn, sn := firstSize-1, secondSize-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return fmt.Errorf("klaes: consistency proof too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return fmt.Errorf("klaes: invalid consistency proof")
+	}
+	return nil
+}
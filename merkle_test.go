@@ -0,0 +1,81 @@
+package klaes
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testTreeSize = 64
+
+func testTree() (*merkleTree, [][]byte) {
+	var t merkleTree
+	var leaves [][]byte
+	for i := 0; i < testTreeSize; i++ {
+		h := merkleLeafHash([]byte{byte(i)})
+		t.append(h)
+		leaves = append(leaves, h)
+	}
+	return &t, leaves
+}
+
+func TestMerkleTreeRoot(t *testing.T) {
+	tree, leaves := testTree()
+	for n := uint64(0); n <= testTreeSize; n++ {
+		if root, want := tree.root(n), merkleRoot(leaves[:n]); !bytes.Equal(root, want) {
+			t.Errorf("root(%v) = %x, want %x", n, root, want)
+		}
+	}
+}
+
+func TestMerkleInclusion(t *testing.T) {
+	tree, leaves := testTree()
+	for n := uint64(1); n <= testTreeSize; n++ {
+		root := tree.root(n)
+		for m := uint64(0); m < n; m++ {
+			path := tree.path(m, n)
+			if err := VerifyInclusion(m, n, leaves[m], path, root); err != nil {
+				t.Errorf("VerifyInclusion(%v, %v) = %v", m, n, err)
+			}
+
+			if len(path) > 0 {
+				path[0] = leaves[m]
+				if err := VerifyInclusion(m, n, leaves[m], path, root); err == nil {
+					t.Errorf("VerifyInclusion(%v, %v) accepted a tampered path", m, n)
+				}
+			}
+			if n > 1 {
+				if err := VerifyInclusion(m, n, leaves[(m+1)%n], tree.path(m, n), root); err == nil {
+					t.Errorf("VerifyInclusion(%v, %v) accepted the wrong leaf", m, n)
+				}
+			}
+		}
+	}
+}
+
+func TestMerkleConsistency(t *testing.T) {
+	tree, _ := testTree()
+	for n := uint64(0); n <= testTreeSize; n++ {
+		for m := uint64(0); m <= n; m++ {
+			proof := tree.consistency(m, n)
+			if err := VerifyConsistency(m, n, tree.root(m), tree.root(n), proof); err != nil {
+				t.Errorf("VerifyConsistency(%v, %v) = %v", m, n, err)
+			}
+
+			if m > 0 && m < n {
+				if err := VerifyConsistency(m, n, tree.root(m-1), tree.root(n), proof); err == nil {
+					t.Errorf("VerifyConsistency(%v, %v) accepted the wrong first root", m, n)
+				}
+			}
+			if len(proof) > 0 {
+				proof[len(proof)-1] = tree.root(n)
+				if err := VerifyConsistency(m, n, tree.root(m), tree.root(n), proof); err == nil {
+					t.Errorf("VerifyConsistency(%v, %v) accepted a tampered proof", m, n)
+				}
+			}
+		}
+	}
+
+	if err := VerifyConsistency(2, 1, tree.root(2), tree.root(1), nil); err == nil {
+		t.Error("VerifyConsistency accepted a shrinking tree")
+	}
+}
@@ -0,0 +1,30 @@
+package klaes
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ClaimNotice returns the subject and the plain text body of a message
+// notifying the owner of the verified key claimed that the key by, adding
+// the email address email, has been imported. It is written in
+// DefaultLocale. held tells whether the new key is held.
+func (s *Server) ClaimNotice(email string, claimed, by [20]byte, held bool) (subject, body string) {
+	tag := s.DefaultLocale
+	if !hasLocale(tag) {
+		tag = "en"
+	}
+	l := &locale{Tag: tag, messages: catalogs[tag]}
+
+	status := "The new key is served along with yours."
+	if held {
+		status = "The new key is held and won't be served until an administrator releases it."
+	}
+
+	subject = fmt.Sprintf(l.T("Another key was uploaded for %v"), email)
+	body = strings.Join([]string{
+		fmt.Sprintf(l.T("The key %X was uploaded to the keyserver with the email address %v, which is already used by your key %X."), by[:], email, claimed[:]),
+		l.T(status) + " " + l.T("If you didn't upload it, please contact the keyserver administrators."),
+	}, "\n\n") + "\n"
+	return subject, body
+}
@@ -0,0 +1,278 @@
+package klaes
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// challengeLifetime is how long a challenge can be answered, as an SQL
+// interval.
+const challengeLifetime = "1 hour"
+
+// maxChallenges is the number of pending challenges allowed per key, since
+// anyone can request them.
+const maxChallenges = 10
+
+var (
+	errKeyNotFound       = errors.New("klaes: key not found")
+	errTooManyChallenges = errors.New("klaes: too many pending challenges for this key, try again later")
+)
+
+func (be *backend) createChallenge(fingerprint []byte, nonce string) error {
+	_, err := be.db.Exec(
+		`DELETE FROM Challenge WHERE
+			creation_time <= now() - interval '` + challengeLifetime + `'`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete expired challenges: %v", err)
+	}
+
+	var id int
+	err = be.db.QueryRow(`SELECT id FROM Key WHERE fingerprint = $1`, fingerprint).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errKeyNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to fetch key: %v", err)
+	}
+
+	// Concurrent requests may slightly exceed the limit, which is fine
+	res, err := be.db.Exec(
+		`INSERT INTO Challenge(nonce, key, creation_time)
+		SELECT $1, $2, now() WHERE
+			(SELECT count(*) FROM Challenge WHERE key = $2) < $3`,
+		nonce, id, maxChallenges,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert challenge: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errTooManyChallenges
+	}
+	return nil
+}
+
+// consumeChallenge deletes a pending challenge and returns the key it was
+// issued for.
+func (be *backend) consumeChallenge(nonce string) (openpgp.EntityList, error) {
+	var fingerprint, packets []byte
+	err := be.db.QueryRow(
+		`DELETE FROM Challenge USING Key WHERE
+			Challenge.nonce = $1 AND
+			Challenge.key = Key.id AND
+			Challenge.creation_time > now() - interval '`+challengeLifetime+`'
+		RETURNING Key.fingerprint, Key.packets`,
+		nonce,
+	).Scan(&fingerprint, &packets)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("klaes: unknown or expired challenge")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to delete challenge: %v", err)
+	}
+
+	if packets, err = be.openPackets(packets, fingerprint); err != nil {
+		return nil, fmt.Errorf("failed to decrypt key: %v", err)
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(packets))
+}
+
+func (be *backend) setSignatureVerified(fingerprint []byte) error {
+	_, err := be.db.Exec(
+		`UPDATE Key SET signature_verified = TRUE WHERE fingerprint = $1`,
+		fingerprint,
+	)
+	return err
+}
+
+func (be *backend) signatureVerified(fingerprint []byte) (bool, error) {
+	var verified bool
+	err := be.db.QueryRow(
+		`SELECT signature_verified FROM Key WHERE fingerprint = $1`,
+		fingerprint,
+	).Scan(&verified)
+	return verified, err
+}
+
+func (be *backend) deleteKey(fingerprint []byte) error {
+	tx, err := be.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %v", err)
+	}
+
+	var id int
+	err = tx.QueryRow(
+		`SELECT id FROM Key WHERE fingerprint = $1 FOR UPDATE`,
+		fingerprint,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return errKeyNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to fetch key: %v", err)
+	}
+
+	for _, table := range []string{"Identity", "KeyVersion", "Challenge"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE key = $1`, id); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete key from %v: %v", table, err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM Key WHERE id = $1`, id); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete key: %v", err)
+	}
+	if err := appendLogEntry(context.Background(), tx, fingerprint, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	be.cache.evict(fingerprint)
+	return nil
+}
+
+// Challenge issues a nonce to be signed with a stored key, proving control of
+// its private key. See VerifyOwnership.
+func (s *Server) Challenge(fingerprint [20]byte) (string, error) {
+	if s.ReadOnly() {
+		return "", ErrReadOnly
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	if err := s.backend.createChallenge(fingerprint[:], nonce); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// VerifyOwnership checks an armored detached signature of a challenge, made
+// by the key it was issued for or one of its signing subkeys. The key is
+// then marked as verified by signature and its fingerprint is returned. A
+// challenge can only be answered once.
+func (s *Server) VerifyOwnership(challenge string, sig io.Reader) ([20]byte, error) {
+	var fingerprint [20]byte
+
+	el, err := s.backend.consumeChallenge(challenge)
+	if err != nil {
+		return fingerprint, err
+	} else if len(el) != 1 {
+		return fingerprint, fmt.Errorf("klaes: expected a single stored key, got %v", len(el))
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(el, strings.NewReader(challenge), sig)
+	if err != nil {
+		return fingerprint, fmt.Errorf("klaes: invalid challenge signature: %v", err)
+	}
+
+	fingerprint = signer.PrimaryKey.Fingerprint
+	if err := s.backend.setSignatureVerified(fingerprint[:]); err != nil {
+		return fingerprint, err
+	}
+	return fingerprint, nil
+}
+
+// Delete removes a key along with its history.
+func (s *Server) Delete(fingerprint [20]byte) error {
+	return s.backend.deleteKey(fingerprint[:])
+}
+
+// serveManage lets key owners prove control of their key and manage it.
+//
+// GET /manage?fingerprint=<hex> returns a challenge. POST /manage with the
+// challenge, an armored detached signature of it in signature and an action
+// (verify, lock or delete) performs the action. The lock action returns the
+// management token.
+func (s *Server) serveManage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		b, err := hex.DecodeString(strings.TrimPrefix(r.URL.Query().Get("fingerprint"), "0x"))
+		var fingerprint [20]byte
+		if err != nil || len(b) != len(fingerprint) {
+			http.Error(w, "Invalid fingerprint", http.StatusBadRequest)
+			return
+		}
+		copy(fingerprint[:], b)
+
+		challenge, err := s.Challenge(fingerprint)
+		if err == errKeyNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err == errTooManyChallenges {
+			w.Header().Set("Retry-After", "3600")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err == ErrReadOnly {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, challenge)
+	case http.MethodPost:
+		if s.ReadOnly() {
+			http.Error(w, ErrReadOnly.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+		challenge := r.FormValue("challenge")
+		sig := r.FormValue("signature")
+
+		action := r.FormValue("action")
+		switch action {
+		case "", "verify", "lock", "delete":
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+
+		fingerprint, err := s.VerifyOwnership(challenge, strings.NewReader(sig))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		switch action {
+		case "lock":
+			token, err := s.Lock(fingerprint)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, token)
+		case "delete":
+			if err := s.Delete(fingerprint); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,106 @@
+package klaes
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Policy controls which keys are served by a lookup surface.
+type Policy struct {
+	// WithholdExpired and WithholdRevoked exclude expired and revoked keys
+	// from lookup results.
+	WithholdExpired bool
+	WithholdRevoked bool
+	// If IncludeOnRequest is set, withheld keys are still returned when the
+	// client sets the "invalid" query parameter to "on".
+	IncludeOnRequest bool
+}
+
+// filter returns an SQL condition to append to a lookup query.
+func (p *Policy) filter(r *http.Request) string {
+	if p.IncludeOnRequest && r.URL.Query().Get("invalid") == "on" {
+		return ""
+	}
+	return p.where()
+}
+
+// where returns the SQL condition enforcing the policy, ignoring
+// IncludeOnRequest.
+func (p *Policy) where() string {
+	var where string
+	if p.WithholdExpired {
+		where += ` AND NOT (Key.expiration_time > 'epoch' AND Key.expiration_time <= now())`
+	}
+	if p.WithholdRevoked {
+		where += ` AND NOT Key.revoked`
+	}
+	return where
+}
+
+// lookuper implements hkp.Lookuper with an additional SQL filter.
+type lookuper struct {
+	ctx    context.Context
+	be     *backend
+	filter string
+}
+
+func (l *lookuper) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
+	where, v := l.be.lookup(req)
+	return l.be.get(l.ctx, where+l.filter, v)
+}
+
+func (l *lookuper) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
+	where, v := l.be.lookup(req)
+	return l.be.index(l.ctx, where+l.filter, v)
+}
+
+// serveHKPGet replies to HKP op=get lookups. hkp.Handler drops revocation
+// signatures when serializing keys, WriteKeyring keeps them.
+func serveHKPGet(w http.ResponseWriter, r *http.Request, l hkp.Lookuper) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	el, err := l.Get(&hkp.LookupRequest{Search: q.Get("search"), Exact: q.Get("exact") == "on"})
+	if err == errUnavailable || isDBFailure(err) {
+		serveUnavailable(w)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(el) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	if err := WriteKeyring(w, el); err != nil {
+		panic(err)
+	}
+}
+
+func (s *Server) serveHKP(w http.ResponseWriter, r *http.Request) {
+	l := &lookuper{ctx: r.Context(), be: &s.backend, filter: s.HKPPolicy.filter(r)}
+
+	if r.URL.Path == hkp.Base+"/lookup" && r.URL.Query().Get("op") == "get" {
+		serveHKPGet(w, r, l)
+		return
+	}
+
+	if s.Degraded() && r.URL.Path == hkp.Base+"/lookup" {
+		// hkp.Handler replies with 500 on errors, check the cache first
+		req := &hkp.LookupRequest{Search: r.URL.Query().Get("search")}
+		if _, err := l.Get(req); err == errUnavailable || isDBFailure(err) {
+			serveUnavailable(w)
+			return
+		}
+	}
+
+	h := hkp.Handler{Lookuper: l}
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,91 @@
+package klaes
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type testLookuper openpgp.EntityList
+
+func (l testLookuper) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
+	return openpgp.EntityList(l), nil
+}
+
+func (l testLookuper) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
+	return nil, nil
+}
+
+// testRevokedEntity generates a key with a key revocation signature.
+func testRevokedEntity(t *testing.T) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Alice", "", "alice@example.org", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet package can't sign key revocations, hash the key ourselves
+	var b bytes.Buffer
+	if err := e.PrimaryKey.Serialize(&b); err != nil {
+		t.Fatal(err)
+	}
+	body := b.Bytes()[2:]
+	if b.Bytes()[1] >= 192 {
+		body = b.Bytes()[3:]
+	}
+	h := sha256.New()
+	e.PrimaryKey.SerializeSignaturePrefix(h)
+	h.Write(body)
+
+	rev := &packet.Signature{
+		SigType:      packet.SigTypeKeyRevocation,
+		PubKeyAlgo:   e.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &e.PrimaryKey.KeyId,
+	}
+	if err := rev.Sign(h, e.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PrimaryKey.VerifyRevocationSignature(rev); err != nil {
+		t.Fatal(err)
+	}
+	e.Revocations = append(e.Revocations, rev)
+	return e
+}
+
+func TestServeHKPGetRevoked(t *testing.T) {
+	e := testRevokedEntity(t)
+
+	r := httptest.NewRequest("GET", hkp.Base+"/lookup?op=get&search=0x"+e.PrimaryKey.KeyIdString(), nil)
+	w := httptest.NewRecorder()
+	serveHKPGet(w, r, testLookuper{e})
+	if w.Code != 200 {
+		t.Fatalf("status = %v, want 200", w.Code)
+	}
+
+	block, err := armor.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := packet.NewReader(block.Body)
+	for {
+		p, err := pr.Next()
+		if err == io.EOF {
+			t.Fatal("served key has no revocation signature")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if sig, ok := p.(*packet.Signature); ok && sig.SigType == packet.SigTypeKeyRevocation {
+			break
+		}
+	}
+}
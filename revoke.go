@@ -0,0 +1,177 @@
+package klaes
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// readRevocation reads a bare key revocation signature, armored or not.
+func readRevocation(r io.Reader) (*packet.OpaquePacket, *packet.Signature, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	r = bytes.NewReader(b)
+	if block, err := armor.Decode(bytes.NewReader(b)); err == nil {
+		r = block.Body
+	}
+
+	op, err := packet.NewOpaqueReader(r).Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("klaes: failed to read revocation: %v", err)
+	} else if op.Tag != tagSignature {
+		return nil, nil, fmt.Errorf("klaes: expected a signature packet")
+	}
+
+	p, err := op.Parse()
+	if err != nil {
+		return nil, nil, fmt.Errorf("klaes: failed to parse revocation: %v", err)
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok || sig.SigType != packet.SigTypeKeyRevocation {
+		return nil, nil, fmt.Errorf("klaes: not a key revocation signature")
+	} else if sig.IssuerKeyId == nil {
+		return nil, nil, fmt.Errorf("klaes: revocation signature without issuer")
+	}
+
+	return op, sig, nil
+}
+
+// revokeKey verifies a key revocation signature against the stored key it
+// was issued by, and merges it into the key.
+func (be *backend) revokeKey(ctx context.Context, op *packet.OpaquePacket, sig *packet.Signature) ([]byte, error) {
+	var fingerprint []byte
+	err := be.guard(ctx, func(ctx context.Context) error {
+		var err error
+		fingerprint, err = be.revokeKeyTx(ctx, op, sig)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	be.cache.evict(fingerprint)
+	return fingerprint, nil
+}
+
+func (be *backend) revokeKeyTx(ctx context.Context, op *packet.OpaquePacket, sig *packet.Signature) ([]byte, error) {
+	tx, err := be.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT fingerprint, packets FROM Key WHERE keyid64 = $1 FOR UPDATE`,
+		int64(*sig.IssuerKeyId),
+	)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		fingerprint, packets []byte
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.fingerprint, &c.packets); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Key IDs can collide, pick the key the signature verifies against
+	for _, candidate := range candidates {
+		packets, err := be.openPackets(candidate.packets, candidate.fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		c, err := readCert(packets)
+		if err != nil {
+			return nil, err
+		}
+		p, err := c.primary.packet.Parse()
+		if err != nil {
+			return nil, err
+		}
+		pub := p.(*packet.PublicKey)
+		if err := pub.VerifyRevocationSignature(sig); err != nil {
+			continue
+		}
+
+		mergeSigs(&c.primary, []*packet.OpaquePacket{op})
+		if packets, err = c.bytes(); err != nil {
+			return nil, err
+		}
+		if _, _, err := be.storeKey(ctx, tx, packets); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		return pub.Fingerprint[:], nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// Revoke reads a bare key revocation signature, also known as a revocation
+// certificate, and applies it to the stored key it was issued for. The
+// fingerprint of the revoked key is returned.
+func (s *Server) Revoke(r io.Reader) ([20]byte, error) {
+	return s.revoke(context.Background(), r)
+}
+
+func (s *Server) revoke(ctx context.Context, r io.Reader) ([20]byte, error) {
+	var fingerprint [20]byte
+	if s.ReadOnly() {
+		return fingerprint, ErrReadOnly
+	}
+
+	op, sig, err := readRevocation(r)
+	if err != nil {
+		return fingerprint, err
+	}
+
+	b, err := s.backend.revokeKey(ctx, op, sig)
+	if err == sql.ErrNoRows {
+		return fingerprint, fmt.Errorf("klaes: no stored key matches the revocation signature")
+	} else if err != nil {
+		return fingerprint, err
+	}
+
+	copy(fingerprint[:], b)
+	return fingerprint, nil
+}
+
+func (s *Server) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := s.revoke(r.Context(), http.MaxBytesReader(w, r.Body, 64*1024)); err == ErrReadOnly {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err == errUnavailable || isDBFailure(err) {
+		serveUnavailable(w)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -8,14 +8,78 @@ CREATE TABLE Key (
 	expiration_time TIMESTAMP WITH TIME ZONE,
 	algo INTEGER NOT NULL,
 	bit_length INTEGER NOT NULL,
-	packets BYTEA NOT NULL
+	packets BYTEA NOT NULL,
+	-- SHA-256 of the stored packets
+	packets_digest BYTEA,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE,
+	-- Held keys aren't served until an operator releases them
+	held BOOLEAN NOT NULL DEFAULT FALSE,
+	-- Deprovisioned keys have identities missing from the directory
+	deprovisioned BOOLEAN NOT NULL DEFAULT FALSE,
+	-- SHA-256 of the management token of locked keys
+	lock_digest BYTEA,
+	-- Set once the owner signed a challenge with the key
+	signature_verified BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 CREATE TABLE Identity (
 	id SERIAL PRIMARY KEY,
 	key INTEGER REFERENCES Key(id),
 	name VARCHAR NOT NULL,
+	email VARCHAR NOT NULL,
 	creation_time TIMESTAMP WITH TIME ZONE NOT NULL,
 	expiration_time TIMESTAMP WITH TIME ZONE,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE,
 	wkd_hash VARCHAR(32)
 );
+
+CREATE TABLE KeyVersion (
+	id SERIAL PRIMARY KEY,
+	key INTEGER REFERENCES Key(id),
+	creation_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	packets BYTEA NOT NULL,
+	packets_digest BYTEA,
+	revoked BOOLEAN NOT NULL
+);
+CREATE INDEX KeyVersion_key ON KeyVersion(key, id);
+
+CREATE TABLE DirectoryEmail (
+	email VARCHAR PRIMARY KEY
+);
+
+CREATE TABLE Challenge (
+	nonce VARCHAR PRIMARY KEY,
+	key INTEGER REFERENCES Key(id),
+	creation_time TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE Submission (
+	id VARCHAR PRIMARY KEY,
+	creation_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	update_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	-- Submitted keys, dropped once processed
+	packets BYTEA,
+	token VARCHAR,
+	-- pending, processing, done or failed
+	status VARCHAR NOT NULL,
+	error VARCHAR
+);
+CREATE INDEX Submission_status ON Submission(status, update_time);
+
+CREATE TABLE KeyringGroup (
+	name VARCHAR NOT NULL,
+	email VARCHAR NOT NULL,
+	PRIMARY KEY (name, email)
+);
+
+-- Transparency log, append-only
+CREATE TABLE LogEntry (
+	id BIGSERIAL PRIMARY KEY,
+	-- Position in the tree, assigned once the entry is committed
+	leaf_index BIGINT UNIQUE,
+	creation_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	fingerprint BYTEA NOT NULL,
+	-- Data hashed into the Merkle tree, see LogEntry.Leaf
+	leaf BYTEA NOT NULL
+);
+CREATE INDEX LogEntry_fingerprint ON LogEntry(fingerprint);
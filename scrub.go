@@ -0,0 +1,124 @@
+package klaes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// scrubKeys verifies the digest of every stored key, and checks that the
+// metadata columns match the stored packets.
+func (be *backend) scrubKeys(report func(msg string)) error {
+	rows, err := be.db.Query(
+		`SELECT
+			id, fingerprint, keyid64, keyid32, creation_time, algo,
+			packets, packets_digest, revoked
+		FROM Key`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id                   int
+			fingerprint, packets []byte
+			digest               []byte
+			keyid64              int64
+			keyid32              int32
+			creationTime         time.Time
+			algo                 int
+			revoked              bool
+		)
+		if err := rows.Scan(&id, &fingerprint, &keyid64, &keyid32, &creationTime, &algo, &packets, &digest, &revoked); err != nil {
+			return err
+		}
+
+		if digest != nil {
+			if sum := sha256.Sum256(packets); !bytes.Equal(sum[:], digest) {
+				report(fmt.Sprintf("key %X: packets digest mismatch", fingerprint))
+				continue
+			}
+		}
+
+		packets, err := be.openPackets(packets, fingerprint)
+		if err != nil {
+			report(fmt.Sprintf("key %X: %v", fingerprint, err))
+			continue
+		}
+		e, err := readEntity(packets)
+		if err != nil {
+			report(fmt.Sprintf("key %X: failed to parse packets: %v", fingerprint, err))
+			continue
+		}
+
+		pub := e.PrimaryKey
+		switch {
+		case !bytes.Equal(pub.Fingerprint[:], fingerprint):
+			report(fmt.Sprintf("key %X: packets have fingerprint %X", fingerprint, pub.Fingerprint[:]))
+		case keyid64 != int64(pub.KeyId):
+			report(fmt.Sprintf("key %X: key ID mismatch", fingerprint))
+		case keyid32 != int32(binary.BigEndian.Uint32(pub.Fingerprint[16:20])):
+			report(fmt.Sprintf("key %X: short key ID mismatch", fingerprint))
+		case !creationTime.Equal(pub.CreationTime):
+			report(fmt.Sprintf("key %X: creation time mismatch", fingerprint))
+		case algo != int(pub.PubKeyAlgo):
+			report(fmt.Sprintf("key %X: algorithm mismatch", fingerprint))
+		case revoked != (len(e.Revocations) > 0):
+			report(fmt.Sprintf("key %X: revocation status mismatch", fingerprint))
+		}
+	}
+
+	return rows.Err()
+}
+
+// scrubKeyVersions verifies the digest of every stored key version.
+func (be *backend) scrubKeyVersions(report func(msg string)) error {
+	rows, err := be.db.Query(
+		`SELECT
+			KeyVersion.id, Key.fingerprint, KeyVersion.packets,
+			KeyVersion.packets_digest
+		FROM KeyVersion, Key WHERE
+			Key.id = KeyVersion.key`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var fingerprint, packets, digest []byte
+		if err := rows.Scan(&id, &fingerprint, &packets, &digest); err != nil {
+			return err
+		}
+
+		if digest != nil {
+			if sum := sha256.Sum256(packets); !bytes.Equal(sum[:], digest) {
+				report(fmt.Sprintf("key version %v: packets digest mismatch", id))
+				continue
+			}
+		}
+
+		packets, err := be.openPackets(packets, fingerprint)
+		if err != nil {
+			report(fmt.Sprintf("key version %v: %v", id, err))
+		} else if _, err := readCert(packets); err != nil {
+			report(fmt.Sprintf("key version %v: failed to parse packets: %v", id, err))
+		}
+	}
+
+	return rows.Err()
+}
+
+// Scrub re-reads all stored packets, verifies their digest and checks them
+// against the key metadata. Each problem found is passed to report.
+func (s *Server) Scrub(report func(msg string)) error {
+	if err := s.backend.scrubKeys(report); err != nil {
+		return err
+	}
+	return s.backend.scrubKeyVersions(report)
+}
@@ -0,0 +1,263 @@
+package klaes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxSubmissionSize = 1024 * 1024
+
+// Submissions being processed for longer than this are considered abandoned
+// (e.g. because the worker crashed) and are queued again.
+const submissionTimeout = "10 minutes"
+
+// Submission status values.
+const (
+	SubmissionPending    = "pending"
+	SubmissionProcessing = "processing"
+	SubmissionDone       = "done"
+	SubmissionFailed     = "failed"
+)
+
+// Submission is a key submission queued for asynchronous processing.
+type Submission struct {
+	ID           string    `json:"id"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	CreationTime time.Time `json:"creation_time"`
+	UpdateTime   time.Time `json:"update_time"`
+}
+
+func (be *backend) enqueueSubmission(id string, keytext []byte, token string) error {
+	sealed, err := be.sealPackets(keytext, []byte(id))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt submission: %v", err)
+	}
+
+	_, err = be.db.Exec(
+		`INSERT INTO Submission(id, creation_time, update_time, packets,
+			token, status)
+		VALUES ($1, now(), now(), $2, $3, $4)`,
+		id, sealed, token, SubmissionPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert submission: %v", err)
+	}
+	return nil
+}
+
+// claimSubmission marks the oldest pending submission as being processed and
+// returns it. An empty ID is returned if the queue is empty.
+func (be *backend) claimSubmission() (id string, keytext []byte, token string, err error) {
+	err = be.db.QueryRow(
+		`UPDATE Submission SET status = $1, update_time = now()
+		WHERE id = (
+			SELECT id FROM Submission WHERE
+				status = $2 OR (
+					status = $1 AND
+					update_time <= now() - interval '`+submissionTimeout+`'
+				)
+			ORDER BY creation_time
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, packets, token`,
+		SubmissionProcessing, SubmissionPending,
+	).Scan(&id, &keytext, &token)
+	if err == sql.ErrNoRows {
+		return "", nil, "", nil
+	} else if err != nil {
+		return "", nil, "", fmt.Errorf("failed to claim submission: %v", err)
+	}
+
+	if keytext, err = be.openPackets(keytext, []byte(id)); err != nil {
+		return id, nil, "", fmt.Errorf("failed to decrypt submission: %v", err)
+	}
+	return id, keytext, token, nil
+}
+
+// finishSubmission records the outcome of a submission. The submitted data
+// isn't needed anymore and is dropped.
+func (be *backend) finishSubmission(id string, procErr error) error {
+	status, msg := SubmissionDone, ""
+	if procErr != nil {
+		status, msg = SubmissionFailed, procErr.Error()
+	}
+
+	_, err := be.db.Exec(
+		`UPDATE Submission SET
+			status = $1, error = $2, update_time = now(), packets = NULL,
+			token = NULL
+		WHERE id = $3`,
+		status, msg, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update submission: %v", err)
+	}
+	return nil
+}
+
+// purgeSubmissions deletes finished submissions last updated before t.
+func (be *backend) purgeSubmissions(t time.Time) (int64, error) {
+	res, err := be.db.Exec(
+		`DELETE FROM Submission WHERE
+			status IN ($1, $2) AND
+			update_time <= $3`,
+		SubmissionDone, SubmissionFailed, t,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete submissions: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+func (be *backend) submission(id string) (*Submission, error) {
+	sub := &Submission{ID: id}
+	var msg sql.NullString
+	err := be.db.QueryRow(
+		`SELECT status, error, creation_time, update_time FROM Submission
+		WHERE id = $1`,
+		id,
+	).Scan(&sub.Status, &msg, &sub.CreationTime, &sub.UpdateTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sub.Error = msg.String
+	return sub, nil
+}
+
+// Submit queues armored or binary keys for import. If a key is locked, token
+// must be its management token. The submission ID is returned.
+func (s *Server) Submit(keytext []byte, token string) (string, error) {
+	if s.ReadOnly() {
+		return "", ErrReadOnly
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	if err := s.backend.enqueueSubmission(id, keytext, token); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ProcessSubmissions imports queued submissions until the queue is empty. It
+// is safe to call concurrently. The number of submissions processed is
+// returned.
+func (s *Server) ProcessSubmissions() (int, error) {
+	n := 0
+	for {
+		id, keytext, token, err := s.backend.claimSubmission()
+		if err != nil {
+			return n, err
+		} else if id == "" {
+			return n, nil
+		}
+
+		var procErr error
+		if keytext != nil {
+			procErr = s.importSubmission(keytext, token)
+		} else {
+			procErr = fmt.Errorf("klaes: submission data unavailable")
+		}
+		if err := s.backend.finishSubmission(id, procErr); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// PurgeSubmissions deletes the status of submissions which finished more
+// than age ago. The number of submissions deleted is returned.
+func (s *Server) PurgeSubmissions(age time.Duration) (int, error) {
+	n, err := s.backend.purgeSubmissions(time.Now().Add(-age))
+	return int(n), err
+}
+
+func (s *Server) importSubmission(keytext []byte, token string) error {
+	el, err := readKeys(bytes.NewReader(keytext))
+	if err != nil {
+		return err
+	} else if len(el) == 0 {
+		return fmt.Errorf("klaes: no public key found")
+	}
+
+	for _, e := range el {
+		if err := s.ImportWithToken(e, token); err != nil {
+			return fmt.Errorf("key %X: %v", e.PrimaryKey.Fingerprint[:], err)
+		}
+	}
+	return nil
+}
+
+// serveAdd queues a HKP op=add submission and replies with 202 and the
+// submission status. The management token of locked keys can be passed in
+// the token form field.
+func (s *Server) serveAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionSize)
+	keytext := r.FormValue("keytext")
+	if keytext == "" {
+		http.Error(w, "Missing keytext", http.StatusBadRequest)
+		return
+	}
+
+	id, err := s.Submit([]byte(keytext), r.FormValue("token"))
+	if err == ErrReadOnly {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", s.basePath()+"/submission/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&Submission{
+		ID:           id,
+		Status:       SubmissionPending,
+		CreationTime: now,
+		UpdateTime:   now,
+	})
+}
+
+// serveSubmission returns the status of a submission.
+func (s *Server) serveSubmission(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, err := s.backend.submission(strings.TrimPrefix(r.URL.Path, "/submission/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if sub == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sub); err != nil {
+		panic(err)
+	}
+}
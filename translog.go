@@ -0,0 +1,527 @@
+package klaes
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const maxLogEntries = 1000
+
+var errLogRange = errors.New("klaes: leaf index or tree size out of range")
+
+const (
+	logLeafVersion = 0
+	logLeafSize    = 2 + 8 + 20 + sha256.Size
+)
+
+// LogEntry is an entry of the transparency log, recording a new version or
+// the deletion of a key.
+type LogEntry struct {
+	Index uint64 `json:"index"`
+	// Timestamp is in milliseconds since the Unix epoch.
+	Timestamp   int64  `json:"timestamp"`
+	Fingerprint string `json:"fingerprint"`
+	Deleted     bool   `json:"deleted"`
+	// Digest is the SHA-256 of the key as returned by HKP lookups, before
+	// ASCII armor, empty for deletions. See KeyDigest.
+	Digest []byte `json:"digest,omitempty"`
+}
+
+// KeyDigest returns the log digest of a binary key as returned by HKP
+// lookups.
+func KeyDigest(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+// logDigest returns the digest of stored key packets, in the serialization
+// used by HKP lookups: serializeEntity, through WriteKeyring.
+func logDigest(packets []byte) ([]byte, error) {
+	e, err := readEntity(packets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	var b bytes.Buffer
+	if err := serializeEntity(&b, e); err != nil {
+		return nil, fmt.Errorf("failed to serialize public key: %v", err)
+	}
+	return KeyDigest(b.Bytes()), nil
+}
+
+// Leaf returns the binary leaf data hashed into the tree: a version byte, a
+// byte set to 1 for deletions, the timestamp as a big-endian uint64, the
+// fingerprint and the digest (zero for deletions).
+func (e *LogEntry) Leaf() ([]byte, error) {
+	fingerprint, err := hex.DecodeString(e.Fingerprint)
+	if err != nil || len(fingerprint) != 20 {
+		return nil, fmt.Errorf("klaes: invalid log entry fingerprint %q", e.Fingerprint)
+	}
+
+	b := make([]byte, logLeafSize)
+	b[0] = logLeafVersion
+	if e.Deleted {
+		b[1] = 1
+	} else if len(e.Digest) != sha256.Size {
+		return nil, fmt.Errorf("klaes: invalid log entry digest")
+	}
+	binary.BigEndian.PutUint64(b[2:10], uint64(e.Timestamp))
+	copy(b[10:30], fingerprint)
+	copy(b[30:], e.Digest)
+	return b, nil
+}
+
+// LeafHash returns the Merkle tree hash of the entry.
+func (e *LogEntry) LeafHash() ([]byte, error) {
+	leaf, err := e.Leaf()
+	if err != nil {
+		return nil, err
+	}
+	return merkleLeafHash(leaf), nil
+}
+
+func parseLogLeaf(index uint64, b []byte) (*LogEntry, error) {
+	if len(b) != logLeafSize || b[0] != logLeafVersion {
+		return nil, fmt.Errorf("klaes: invalid log leaf %v", index)
+	}
+	e := &LogEntry{
+		Index:       index,
+		Timestamp:   int64(binary.BigEndian.Uint64(b[2:10])),
+		Fingerprint: fmt.Sprintf("%X", b[10:30]),
+		Deleted:     b[1] == 1,
+	}
+	if !e.Deleted {
+		e.Digest = b[30:]
+	}
+	return e, nil
+}
+
+// SignedTreeHead is a tree size and root hash signed by the log.
+type SignedTreeHead struct {
+	TreeSize uint64 `json:"tree_size"`
+	// Timestamp is in milliseconds since the Unix epoch.
+	Timestamp int64  `json:"timestamp"`
+	RootHash  []byte `json:"root_hash"`
+	Signature []byte `json:"signature"`
+}
+
+func (sth *SignedTreeHead) signedData() []byte {
+	var b bytes.Buffer
+	b.WriteString("klaes tree head v0\x00")
+	binary.Write(&b, binary.BigEndian, sth.TreeSize)
+	binary.Write(&b, binary.BigEndian, sth.Timestamp)
+	b.Write(sth.RootHash)
+	return b.Bytes()
+}
+
+// Verify checks the Ed25519 signature of the tree head.
+func (sth *SignedTreeHead) Verify(pub ed25519.PublicKey) error {
+	if !ed25519.Verify(pub, sth.signedData(), sth.Signature) {
+		return fmt.Errorf("klaes: invalid tree head signature")
+	}
+	return nil
+}
+
+// VerifyEntries checks that the entries are the complete contents of the
+// tree, in order.
+func (sth *SignedTreeHead) VerifyEntries(entries []LogEntry) error {
+	if uint64(len(entries)) != sth.TreeSize {
+		return fmt.Errorf("klaes: expected %v log entries, got %v", sth.TreeSize, len(entries))
+	}
+
+	leaves := make([][]byte, len(entries))
+	for i, e := range entries {
+		if e.Index != uint64(i) {
+			return fmt.Errorf("klaes: expected log entry %v, got %v", i, e.Index)
+		}
+		leafHash, err := e.LeafHash()
+		if err != nil {
+			return err
+		}
+		leaves[i] = leafHash
+	}
+
+	if !bytes.Equal(merkleRoot(leaves), sth.RootHash) {
+		return fmt.Errorf("klaes: log entries don't match the tree head")
+	}
+	return nil
+}
+
+// InclusionProof is the audit path of a log entry in a tree.
+type InclusionProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	TreeSize  uint64   `json:"tree_size"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// ConsistencyProof proves that a tree is an extension of an older one.
+type ConsistencyProof struct {
+	First  uint64   `json:"first"`
+	Second uint64   `json:"second"`
+	Path   [][]byte `json:"path"`
+}
+
+// appendLogEntry adds an entry to the transparency log. Entries are given
+// their position in the tree once committed, by sequenceLogEntries.
+func appendLogEntry(ctx context.Context, tx *sql.Tx, fingerprint []byte, packets []byte) error {
+	e := LogEntry{
+		Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+		Fingerprint: fmt.Sprintf("%X", fingerprint),
+		Deleted:     packets == nil,
+	}
+	if packets != nil {
+		digest, err := logDigest(packets)
+		if err != nil {
+			return err
+		}
+		e.Digest = digest
+	}
+	leaf, err := e.Leaf()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO LogEntry(creation_time, fingerprint, leaf)
+		VALUES ($1, $2, $3)`,
+		time.Unix(0, e.Timestamp*int64(time.Millisecond)), fingerprint, leaf,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert log entry: %v", err)
+	}
+	return nil
+}
+
+func (be *backend) logEntries(where string, args ...interface{}) ([]LogEntry, error) {
+	rows, err := be.db.Query(
+		`SELECT leaf_index, leaf FROM LogEntry WHERE
+			leaf_index IS NOT NULL AND
+			`+where+`
+		ORDER BY leaf_index`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LogEntry{}
+	for rows.Next() {
+		var index int64
+		var leaf []byte
+		if err := rows.Scan(&index, &leaf); err != nil {
+			return nil, err
+		}
+		e, err := parseLogLeaf(uint64(index), leaf)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+// sequenceLogEntries numbers the committed entries which haven't been added
+// to the tree yet, in insertion order. The table lock only conflicts with
+// other sequencers, not with appendLogEntry.
+func (be *backend) sequenceLogEntries() error {
+	tx, err := be.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`LOCK TABLE LogEntry IN SHARE UPDATE EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("failed to lock log: %v", err)
+	}
+
+	var size int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(leaf_index) + 1, 0) FROM LogEntry`).Scan(&size); err != nil {
+		return fmt.Errorf("failed to fetch log size: %v", err)
+	}
+
+	_, err = tx.Exec(
+		`UPDATE LogEntry SET leaf_index = seq.leaf_index
+		FROM (
+			SELECT id, $1 + row_number() OVER (ORDER BY id) - 1 AS leaf_index
+			FROM LogEntry WHERE leaf_index IS NULL
+		) AS seq
+		WHERE LogEntry.id = seq.id`,
+		size,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to sequence log entries: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// logSyncInterval is the minimum delay between two loads of new log entries.
+const logSyncInterval = time.Second
+
+// transparencyLog keeps the tree of the log in memory. The log is
+// append-only, so only new entries need to be loaded.
+type transparencyLog struct {
+	mu     sync.Mutex
+	tree   merkleTree
+	synced time.Time
+	key    ed25519.PrivateKey
+	sth    *SignedTreeHead
+}
+
+// sync sequences and loads new entries, at most once per logSyncInterval,
+// and returns the tree size. The caller must hold the lock.
+func (l *transparencyLog) sync(be *backend) (uint64, error) {
+	if time.Since(l.synced) < logSyncInterval {
+		return l.tree.size(), nil
+	}
+
+	if err := be.sequenceLogEntries(); err != nil {
+		return 0, err
+	}
+
+	rows, err := be.db.Query(
+		`SELECT leaf_index, leaf FROM LogEntry WHERE
+			leaf_index >= $1
+		ORDER BY leaf_index`,
+		int64(l.tree.size()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var index int64
+		var leaf []byte
+		if err := rows.Scan(&index, &leaf); err != nil {
+			return 0, err
+		}
+		if uint64(index) != l.tree.size() {
+			return 0, fmt.Errorf("klaes: missing log entry %v", l.tree.size())
+		}
+		l.tree.append(merkleLeafHash(leaf))
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	l.synced = time.Now()
+	return l.tree.size(), nil
+}
+
+// SignLog sets the Ed25519 private key seed used to sign tree heads of the
+// transparency log.
+func (s *Server) SignLog(seed []byte) error {
+	if len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("klaes: log signing key must be %v bytes long", ed25519.SeedSize)
+	}
+	s.log.key = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+// LogPublicKey returns the public key verifying signed tree heads, or nil if
+// SignLog hasn't been called.
+func (s *Server) LogPublicKey() ed25519.PublicKey {
+	if s.log.key == nil {
+		return nil
+	}
+	return s.log.key.Public().(ed25519.PublicKey)
+}
+
+// SignedTreeHead returns the current signed tree head of the transparency
+// log.
+func (s *Server) SignedTreeHead() (*SignedTreeHead, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	if s.log.key == nil {
+		return nil, fmt.Errorf("klaes: no log signing key configured")
+	}
+
+	size, err := s.log.sync(&s.backend)
+	if err != nil {
+		return nil, err
+	}
+	if s.log.sth != nil && s.log.sth.TreeSize == size {
+		return s.log.sth, nil
+	}
+
+	sth := &SignedTreeHead{
+		TreeSize:  size,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		RootHash:  s.log.tree.root(size),
+	}
+	sth.Signature = ed25519.Sign(s.log.key, sth.signedData())
+	s.log.sth = sth
+	return sth, nil
+}
+
+// InclusionProof returns the audit path of a log entry in the tree of the
+// given size.
+func (s *Server) InclusionProof(index, treeSize uint64) (*InclusionProof, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	size, err := s.log.sync(&s.backend)
+	if err != nil {
+		return nil, err
+	}
+	if index >= treeSize || treeSize > size {
+		return nil, errLogRange
+	}
+
+	return &InclusionProof{
+		LeafIndex: index,
+		TreeSize:  treeSize,
+		AuditPath: s.log.tree.path(index, treeSize),
+	}, nil
+}
+
+// ConsistencyProof returns the proof that the tree of size second is an
+// extension of the tree of size first.
+func (s *Server) ConsistencyProof(first, second uint64) (*ConsistencyProof, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	size, err := s.log.sync(&s.backend)
+	if err != nil {
+		return nil, err
+	}
+	if first > second || second > size {
+		return nil, errLogRange
+	}
+
+	return &ConsistencyProof{
+		First:  first,
+		Second: second,
+		Path:   s.log.tree.consistency(first, second),
+	}, nil
+}
+
+func parseUintParam(q url.Values, name string) (uint64, error) {
+	n, err := strconv.ParseUint(q.Get(name), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v parameter", name)
+	}
+	return n, nil
+}
+
+// serveLog exposes the transparency log:
+//
+//   - GET /log/sth returns the signed tree head
+//   - GET /log/entries?start=<n>&end=<n> returns entries in [start, end), or
+//     with ?fingerprint=<hex> the entries of a key
+//   - GET /log/inclusion?index=<n>&tree_size=<n> returns an inclusion proof
+//   - GET /log/consistency?first=<n>&second=<n> returns a consistency proof
+func (s *Server) serveLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	var v interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/log/") {
+	case "sth":
+		sth, err := s.SignedTreeHead()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v = sth
+	case "entries":
+		var entries []LogEntry
+		var err error
+		if fingerprint := q.Get("fingerprint"); fingerprint != "" {
+			b, decodeErr := hex.DecodeString(strings.TrimPrefix(fingerprint, "0x"))
+			if decodeErr != nil || len(b) != 20 {
+				http.Error(w, "Invalid fingerprint", http.StatusBadRequest)
+				return
+			}
+			entries, err = s.backend.logEntries("fingerprint = $1", b)
+		} else {
+			start, startErr := parseUintParam(q, "start")
+			end, endErr := parseUintParam(q, "end")
+			if startErr != nil || endErr != nil || start > end {
+				http.Error(w, "Invalid start or end parameter", http.StatusBadRequest)
+				return
+			}
+			if end-start > maxLogEntries {
+				end = start + maxLogEntries
+			}
+			entries, err = s.backend.logEntries("leaf_index >= $1 AND leaf_index < $2", int64(start), int64(end))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v = entries
+	case "inclusion":
+		index, err := parseUintParam(q, "index")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		treeSize, err := parseUintParam(q, "tree_size")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		proof, err := s.InclusionProof(index, treeSize)
+		if err == errLogRange {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v = proof
+	case "consistency":
+		first, err := parseUintParam(q, "first")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		second, err := parseUintParam(q, "second")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		proof, err := s.ConsistencyProof(first, second)
+		if err == errLogRange {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v = proof
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,98 @@
+package klaes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestLogLeafRoundTrip(t *testing.T) {
+	digest := sha256.Sum256([]byte("key"))
+	entries := []LogEntry{
+		{
+			Index:       3,
+			Timestamp:   1600000000000,
+			Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+			Digest:      digest[:],
+		},
+		{
+			Index:       4,
+			Timestamp:   1600000001000,
+			Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+			Deleted:     true,
+		},
+	}
+
+	for _, e := range entries {
+		leaf, err := e.Leaf()
+		if err != nil {
+			t.Fatalf("Leaf() = %v", err)
+		}
+		got, err := parseLogLeaf(e.Index, leaf)
+		if err != nil {
+			t.Fatalf("parseLogLeaf() = %v", err)
+		}
+		if !reflect.DeepEqual(*got, e) {
+			t.Errorf("parseLogLeaf(Leaf()) = %+v, want %+v", *got, e)
+		}
+
+		leaf2, err := got.Leaf()
+		if err != nil {
+			t.Fatalf("Leaf() = %v", err)
+		}
+		if !bytes.Equal(leaf, leaf2) {
+			t.Errorf("Leaf() = %x, want %x", leaf2, leaf)
+		}
+	}
+}
+
+func TestLogLeafInvalid(t *testing.T) {
+	digest := sha256.Sum256(nil)
+	entries := []LogEntry{
+		{Fingerprint: "0123", Digest: digest[:]},
+		{Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567"},
+	}
+	for _, e := range entries {
+		if _, err := e.Leaf(); err == nil {
+			t.Errorf("Leaf() accepted %+v", e)
+		}
+	}
+
+	if _, err := parseLogLeaf(0, make([]byte, logLeafSize-1)); err == nil {
+		t.Error("parseLogLeaf() accepted a truncated leaf")
+	}
+}
+
+func TestLogDigestHKP(t *testing.T) {
+	e := testRevokedEntity(t)
+	var b bytes.Buffer
+	if err := serializeEntity(&b, e); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := logDigest(b.Bytes())
+	if err != nil {
+		t.Fatalf("logDigest() = %v", err)
+	}
+
+	// The audit compares the log digest with the key served over HKP
+	r := httptest.NewRequest("GET", hkp.Base+"/lookup?op=get&search=0x"+e.PrimaryKey.KeyIdString(), nil)
+	w := httptest.NewRecorder()
+	serveHKPGet(w, r, testLookuper{e})
+	block, err := armor.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := KeyDigest(served); !bytes.Equal(digest, want) {
+		t.Errorf("logDigest() = %x, want %x", digest, want)
+	}
+}
@@ -0,0 +1,309 @@
+package klaes
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var searchTemplate = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale.Tag}}">
+<head>
+<meta charset="utf-8">
+<title>{{if .Query}}{{.Query}} - {{end}}klaes</title>
+<link rel="search" type="application/opensearchdescription+xml" href="{{.BasePath}}/opensearch.xml" title="klaes">
+</head>
+<body>
+<form action="{{.BasePath}}/search" method="get">
+<input type="search" name="q" value="{{.Query}}" autofocus>
+<button type="submit">{{.Locale.T "Search"}}</button>
+</form>
+{{if .Query}}
+{{if .Keys}}
+<ul>
+{{range .Keys}}
+<li>
+<a href="{{.URL}}"><code>{{.Fingerprint}}</code></a>
+<ul>{{range .Identities}}<li>{{.}}</li>{{end}}</ul>
+</li>
+{{end}}
+</ul>
+{{else}}
+<p>{{.Locale.T "No keys found."}}</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+var keyTemplate = template.Must(template.New("key").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale.Tag}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Fingerprint}} - klaes</title>
+</head>
+<body>
+<h1><code>{{.Fingerprint}}</code></h1>
+<img src="{{.QRCode}}" alt="{{.URI}}" width="256" height="256">
+<p><input type="text" value="{{.FingerprintHex}}" size="44" readonly onfocus="this.select()"></p>
+<p>
+{{.Locale.T "Created"}} {{.CreationTime.Format "2006-01-02"}}
+{{- if not .ExpirationTime.IsZero}}, {{.Locale.T "expires"}} {{.ExpirationTime.Format "2006-01-02"}}{{end}}
+{{- if .Revoked}}, <strong>{{.Locale.T "revoked"}}</strong>{{end}}
+</p>
+{{if .SignatureVerified}}<p>{{.Locale.T "Ownership verified by signature"}}</p>{{end}}
+<p><a href="{{.DownloadURL}}">{{.Locale.T "Download"}}</a></p>
+<h2>{{.Locale.T "User IDs"}}</h2>
+<ul>
+{{range .Identities}}<li>{{.}}</li>{{end}}
+</ul>
+{{$locale := .Locale -}}
+{{if .Subkeys}}
+<h2>{{.Locale.T "Subkeys"}}</h2>
+<ul>
+{{range .Subkeys}}
+<li>
+<code>{{.Fingerprint}}</code>
+{{.Algo}} {{.BitLength}} {{$locale.T "bits"}},
+{{$locale.T "created"}} {{.CreationTime.Format "2006-01-02"}}
+{{- if not .ExpirationTime.IsZero}}, {{$locale.T "expires"}} {{.ExpirationTime.Format "2006-01-02"}}{{end}}
+{{- if .Revoked}}, <strong>{{$locale.T "revoked"}}</strong>{{end}}
+</li>
+{{end}}
+</ul>
+{{end}}
+</body>
+</html>
+`))
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr"`
+	Template string `xml:"template,attr"`
+}
+
+type openSearchDescription struct {
+	XMLName       xml.Name      `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string        `xml:"ShortName"`
+	Description   string        `xml:"Description"`
+	InputEncoding string        `xml:"InputEncoding"`
+	URL           openSearchURL `xml:"Url"`
+}
+
+type keySubkey struct {
+	Fingerprint    string
+	Algo           string
+	BitLength      uint16
+	CreationTime   time.Time
+	ExpirationTime time.Time
+	Revoked        bool
+}
+
+type searchKey struct {
+	Fingerprint string
+	URL         string
+	Identities  []string
+}
+
+// formatFingerprint splits a fingerprint in groups of four hexadecimal
+// digits.
+func formatFingerprint(fingerprint []byte) string {
+	s := fmt.Sprintf("%X", fingerprint)
+	var groups []string
+	for len(s) > 4 {
+		groups = append(groups, s[:4])
+		s = s[4:]
+	}
+	groups = append(groups, s)
+	return strings.Join(groups, " ")
+}
+
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := struct {
+		BasePath string
+		Locale   *locale
+		Query    string
+		Keys     []searchKey
+	}{
+		BasePath: s.basePath(),
+		Locale:   negotiateLocale(r, s.DefaultLocale),
+		Query:    strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+
+	if data.Query != "" {
+		where, v := s.backend.searchLookup(data.Query)
+		keys, err := s.backend.index(r.Context(), where+s.HKPPolicy.filter(r), v)
+		if err == errUnavailable || isDBFailure(err) {
+			serveUnavailable(w)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid search query", http.StatusBadRequest)
+			return
+		}
+
+		for _, key := range keys {
+			k := searchKey{
+				Fingerprint: formatFingerprint(key.Fingerprint[:]),
+				URL:         fmt.Sprintf("%v/key/%X", data.BasePath, key.Fingerprint[:]),
+			}
+			for _, ident := range key.Identities {
+				k.Identities = append(k.Identities, ident.Name)
+			}
+			data.Keys = append(data.Keys, k)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", data.Locale.Tag)
+	w.Header().Add("Vary", "Accept-Language")
+	if err := searchTemplate.Execute(w, &data); err != nil {
+		panic(err)
+	}
+}
+
+func algoName(algo packet.PublicKeyAlgorithm) string {
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		return "RSA"
+	case packet.PubKeyAlgoElGamal:
+		return "ElGamal"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	default:
+		return fmt.Sprintf("algorithm %v", int(algo))
+	}
+}
+
+// serveKey renders a page with the details of a key, including a QR code
+// with its OPENPGP4FPR URI.
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	search := "0x" + strings.TrimPrefix(r.URL.Path, "/key/")
+	if hkp.ParseKeyIDSearch(search).Fingerprint() == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	l := &lookuper{be: &s.backend, filter: s.HKPPolicy.filter(r)}
+	el, err := l.Get(&hkp.LookupRequest{Search: search})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(el) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	e := el[0]
+
+	fingerprintHex := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	uri := "OPENPGP4FPR:" + fingerprintHex
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q := url.Values{}
+	q.Set("op", "get")
+	q.Set("search", "0x"+fingerprintHex)
+
+	data := struct {
+		Locale            *locale
+		Fingerprint       string
+		FingerprintHex    string
+		URI               string
+		QRCode            template.URL
+		DownloadURL       string
+		CreationTime      time.Time
+		ExpirationTime    time.Time
+		Revoked           bool
+		SignatureVerified bool
+		Identities        []string
+		Subkeys           []keySubkey
+	}{
+		Locale:         negotiateLocale(r, s.DefaultLocale),
+		Fingerprint:    formatFingerprint(e.PrimaryKey.Fingerprint[:]),
+		FingerprintHex: fingerprintHex,
+		URI:            uri,
+		QRCode:         template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		DownloadURL:    s.basePath() + hkp.Base + "/lookup?" + q.Encode(),
+		CreationTime:   e.PrimaryKey.CreationTime,
+		ExpirationTime: keyExpirationTime(e.PrimaryKey, primarySelfSignature(e)),
+		Revoked:        len(e.Revocations) > 0,
+	}
+
+	data.SignatureVerified, err = s.backend.signatureVerified(e.PrimaryKey.Fingerprint[:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, ident := range e.Identities {
+		data.Identities = append(data.Identities, ident.Name)
+	}
+	sort.Strings(data.Identities)
+
+	for _, subkey := range e.Subkeys {
+		bitLength, _ := subkey.PublicKey.BitLength()
+		data.Subkeys = append(data.Subkeys, keySubkey{
+			Fingerprint:    formatFingerprint(subkey.PublicKey.Fingerprint[:]),
+			Algo:           algoName(subkey.PublicKey.PubKeyAlgo),
+			BitLength:      bitLength,
+			CreationTime:   subkey.PublicKey.CreationTime,
+			ExpirationTime: keyExpirationTime(subkey.PublicKey, subkey.Sig),
+			Revoked:        subkey.Sig.SigType == packet.SigTypeSubkeyRevocation,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", data.Locale.Tag)
+	w.Header().Add("Vary", "Accept-Language")
+	if err := keyTemplate.Execute(w, &data); err != nil {
+		panic(err)
+	}
+}
+
+// serveOpenSearch lets browsers add the search page as a search engine.
+func (s *Server) serveOpenSearch(w http.ResponseWriter, r *http.Request) {
+	desc := openSearchDescription{
+		ShortName:     "klaes",
+		Description:   "OpenPGP keyserver search",
+		InputEncoding: "UTF-8",
+		URL: openSearchURL{
+			Type:     "text/html",
+			Method:   "get",
+			Template: s.baseURL(r) + "/search?q={searchTerms}",
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(&desc); err != nil {
+		panic(err)
+	}
+}
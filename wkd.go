@@ -0,0 +1,117 @@
+package klaes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-openpgp-wkd"
+)
+
+// WKDMethod is a set of Web Key Directory lookup methods.
+type WKDMethod int
+
+const (
+	// WKDDirect serves https://example.org/.well-known/openpgpkey/hu/...
+	WKDDirect WKDMethod = 1 << iota
+	// WKDAdvanced serves
+	// https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/...
+	WKDAdvanced
+)
+
+// WKDDomain configures Web Key Directory lookups for a domain.
+type WKDDomain struct {
+	// Methods is the set of enabled lookup methods. Zero enables both.
+	Methods WKDMethod
+	// If StripPlusTag is set, a lookup for user+tag@example.org with the "l"
+	// query parameter returns the keys for user@example.org.
+	StripPlusTag bool
+}
+
+func (s *Server) wkdDomain(domain string) (*WKDDomain, bool) {
+	if s.WKDDomains == nil {
+		return &WKDDomain{}, true
+	}
+	d, ok := s.WKDDomains[domain]
+	return &d, ok
+}
+
+func (s *Server) serveWKD(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, wkd.Base+"/")
+
+	// The direct method uses the request host as the domain, the advanced
+	// method puts the domain in the path
+	method := WKDDirect
+	domain := r.Host
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	if i := strings.IndexByte(path, '/'); i >= 0 && path[:i] != "hu" {
+		method = WKDAdvanced
+		domain = path[:i]
+		path = path[i+1:]
+	}
+	domain = strings.ToLower(domain)
+
+	d, ok := s.wkdDomain(domain)
+	if !ok || (d.Methods != 0 && d.Methods&method == 0) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if method == WKDAdvanced {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+
+	if path == "policy" {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "protocol-version: %v\n", wkd.Version)
+		return
+	}
+
+	if !strings.HasPrefix(path, "hu/") {
+		http.NotFound(w, r)
+		return
+	}
+	hash := strings.TrimPrefix(path, "hu/")
+
+	where := "Identity.wkd_hash = $1 AND split_part(Identity.email, '@', 2) = $2"
+	args := []interface{}{hash, domain}
+	if local := r.URL.Query().Get("l"); local != "" {
+		// The hash is computed over the lowercase local part, so l must
+		// be consistent with it
+		if h, err := wkd.HashAddress(local + "@" + domain); err != nil || h != hash {
+			http.NotFound(w, r)
+			return
+		}
+
+		addr := strings.ToLower(local) + "@" + domain
+		where, args = "Identity.email = $1", []interface{}{addr}
+		if i := strings.IndexByte(local, '+'); i > 0 && d.StripPlusTag {
+			where += " OR Identity.email = $2"
+			args = append(args, strings.ToLower(local[:i])+"@"+domain)
+			where = "(" + where + ")"
+		}
+	}
+
+	filter := s.WKDPolicy.filter(r)
+	el, err := s.backend.discover(r.Context(), where+filter, args...)
+	if err == errUnavailable || isDBFailure(err) {
+		serveUnavailable(w)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(el) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	for _, e := range el {
+		if err := serializeEntity(w, e); err != nil {
+			panic(err)
+		}
+	}
+}